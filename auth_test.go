@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/log"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+// fakeTokenEndpoint issues token-1, token-2, ... to a single OAuth 2 client
+// using the client credentials grant.
+type fakeTokenEndpoint struct {
+	mu     sync.Mutex
+	grants int
+}
+
+func (e *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if r.Method != "POST" || r.FormValue("grant_type") != "client_credentials" || id != "monitor" || secret != "s3cret" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	e.mu.Lock()
+	e.grants++
+	token := fmt.Sprintf("token-%d", e.grants)
+	e.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": token, "token_type": "bearer", "expires_in": 3600})
+}
+
+func (e *fakeTokenEndpoint) Grants() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.grants
+}
+
+func TestCollectBearerToken(t *testing.T) {
+	f, err := ioutil.TempFile("", "rabbitmq-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+
+	cases := []struct {
+		name  string
+		token string
+		cfg   Config
+	}{
+		{name: "static", token: "static", cfg: Config{Auth: "bearer", BearerToken: "static"}},
+		{name: "file", token: "from-file", cfg: Config{Auth: "bearer", BearerTokenFile: f.Name()}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := fakeManagement{Nodes: 1, Queues: 3, Token: c.token}
+			srv := newFakeManagement(&fake)
+			defer srv.Close()
+
+			c.cfg.Cluster, c.cfg.Host = "c", srv.URL
+			rmqc, err := rmqClient(c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := runCollect(t, rmqc, c.cfg, argumentList{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCollectOAuthClientCredentials(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{}
+	tokens := httptest.NewServer(endpoint)
+	defer tokens.Close()
+	fake := fakeManagement{Nodes: 1, Queues: 300, Exchanges: 2, Token: "token-1"}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	cfg := Config{
+		Cluster:           "c",
+		Host:              srv.URL,
+		Workers:           2,
+		Auth:              "oauth2",
+		OAuthTokenURL:     tokens.URL,
+		OAuthClientID:     "monitor",
+		OAuthClientSecret: "s3cret",
+	}
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	if grants := endpoint.Grants(); grants != 1 {
+		t.Errorf("expected the token to be cached for the whole run, got %d grants", grants)
+	}
+
+	// Revoking the token makes the client fetch a new one.
+	fake.mu.Lock()
+	fake.Token = "token-2"
+	fake.mu.Unlock()
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	if grants := endpoint.Grants(); grants != 2 {
+		t.Errorf("expected a new token after a 401, got %d grants", grants)
+	}
+
+	cfg.OAuthClientSecret = "wrong"
+	rmqc, _ = rmqClient(cfg)
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err == nil {
+		t.Error("expected a rejected client to fail")
+	}
+}
+
+func TestOAuthTokenKeptBetweenRuns(t *testing.T) {
+	endpoint := &fakeTokenEndpoint{}
+	tokens := httptest.NewServer(endpoint)
+	defer tokens.Close()
+	fake := fakeManagement{Nodes: 1, Queues: 3, Token: "token-1"}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "rabbitmq-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "state.json")
+	cfg := Config{
+		Cluster:           "c",
+		Host:              srv.URL,
+		Workers:           1,
+		Auth:              "oauth2",
+		OAuthTokenURL:     tokens.URL,
+		OAuthClientID:     "monitor",
+		OAuthClientSecret: "s3cret",
+		TokenDir:          dir,
+	}
+	// Each run starts a new client and state, as each run of the agent does.
+	for run := 0; run < 2; run++ {
+		state, err := persist.NewFileStore(statePath, log.NewStdErr(false), persist.DefaultTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.State = state
+		rmqc, err := rmqClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if grants := endpoint.Grants(); grants != 1 {
+		t.Errorf("expected the stored token to be reused, got %d grants", grants)
+	}
+	if data, err := ioutil.ReadFile(statePath); err != nil || strings.Contains(string(data), "token-1") {
+		t.Errorf("expected the state file to hold no token, got %s %v", data, err)
+	}
+	tokenPath := filepath.Join(dir, tokenFileName(cfg))
+	if info, err := os.Stat(tokenPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the token file to be readable by its owner only, got %v %v", info, err)
+	}
+
+	// A stored token about to expire is replaced.
+	if err := writePrivateFile(tokenPath, oauthToken{Token: "token-1", Expiry: time.Now().Add(10 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.Token = "token-2"
+	fake.mu.Unlock()
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	var stored oauthToken
+	if data, err := ioutil.ReadFile(tokenPath); err != nil || json.Unmarshal(data, &stored) != nil || stored.Token != "token-2" {
+		t.Errorf("expected the new token to be stored, got %+v %v", stored, err)
+	}
+	if grants := endpoint.Grants(); grants != 2 {
+		t.Errorf("expected a new token before expiry, got %d grants", grants)
+	}
+}
+
+func TestTokenSourceConfig(t *testing.T) {
+	for _, cfg := range []Config{{Auth: "bearer"}, {Auth: "oauth2"}, {Auth: "kerberos"}} {
+		if _, err := tokenSource(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+	ts, err := tokenSource(Config{})
+	if err != nil || ts != nil {
+		t.Errorf("expected basic auth by default, got %v %v", ts, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+)
+
+// deadLetterTarget is where a queue's rejected, expired and overflowing
+// messages are republished.
+type deadLetterTarget struct {
+	Exchange string
+	// RoutingKey replaces the message's own routing keys when set.
+	RoutingKey    string
+	HasRoutingKey bool
+}
+
+func stringArgument(args map[string]interface{}, key string) (string, bool) {
+	v, ok := args[key].(string)
+	return v, ok
+}
+
+// resolveDeadLetter returns the queue's effective dead-letter target. As
+// in RabbitMQ, queue arguments take precedence over the queue's policy.
+func resolveDeadLetter(q rabbithole.QueueInfo, r *routing) (deadLetterTarget, bool) {
+	def := r.policyDefinition(q.Vhost, q.Policy)
+	var target deadLetterTarget
+	var ok bool
+	if target.Exchange, ok = stringArgument(q.Arguments, "x-dead-letter-exchange"); !ok {
+		if target.Exchange, ok = stringArgument(def, "dead-letter-exchange"); !ok {
+			return target, false
+		}
+	}
+	if target.RoutingKey, target.HasRoutingKey = stringArgument(q.Arguments, "x-dead-letter-routing-key"); !target.HasRoutingKey {
+		target.RoutingKey, target.HasRoutingKey = stringArgument(def, "dead-letter-routing-key")
+	}
+	return target, true
+}
+
+// deadLetterQueues returns the queues a message dead-lettered from q
+// reaches. Without a dead-letter routing key the message keeps the keys
+// it was published with, so every key that routes into q is tried.
+func deadLetterQueues(q rabbithole.QueueInfo, target deadLetterTarget, r *routing) []string {
+	keys := []string{target.RoutingKey}
+	if !target.HasRoutingKey {
+		keys = r.routingKeysInto(q.Vhost, q.Name)
+	}
+	var queues []string
+	for _, name := range r.queuesFor(q.Vhost, target.Exchange, keys) {
+		if name != q.Name {
+			queues = append(queues, name)
+		}
+	}
+	return queues
+}
+
+// deadLetters links every queue with a dead-letter target to the queues
+// its messages end up in, across the concurrently fetched queue pages.
+// Once every page is in, finish reports each dead-letter queue's depth on
+// its source queues.
+type deadLetters struct {
+	routing *routing
+	cfg     Config
+
+	mu      sync.Mutex
+	queues  map[string]trackedQueue
+	targets map[string][]string
+}
+
+type trackedQueue struct {
+	set         *metric.Set
+	messages    int
+	publishRate float32
+}
+
+func newDeadLetters(r *routing, cfg Config) *deadLetters {
+	return &deadLetters{routing: r, cfg: cfg, queues: map[string]trackedQueue{}, targets: map[string][]string{}}
+}
+
+// track records the queue reported on set and its dead-letter settings.
+func (d *deadLetters) track(q rabbithole.QueueInfo, set *metric.Set) {
+	name := queueEntityName(d.cfg, q.Vhost, q.Name)
+	var dlqs []string
+	if target, ok := resolveDeadLetter(q, d.routing); ok {
+		exchange := target.Exchange
+		if exchange == "" {
+			exchange = "amq.default"
+		}
+		set.SetMetric("dead_letter_exchange", exchange, metric.ATTRIBUTE)
+		if target.HasRoutingKey {
+			set.SetMetric("dead_letter_routing_key", target.RoutingKey, metric.ATTRIBUTE)
+		}
+		for _, dlq := range deadLetterQueues(q, target, d.routing) {
+			dlqs = append(dlqs, queueEntityName(d.cfg, q.Vhost, dlq))
+		}
+		if len(dlqs) > 0 {
+			set.SetMetric("dead_letter_queue", strings.Join(dlqs, ","), metric.ATTRIBUTE)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queues[name] = trackedQueue{set: set, messages: q.Messages, publishRate: q.MessageStats.PublishDetails.Rate}
+	if len(dlqs) > 0 {
+		d.targets[name] = dlqs
+	}
+}
+
+// finish marks the dead-letter queues and reports their depth, and their
+// publish rate outside low overhead mode, on the source queues. Queues on
+// pages that couldn't be fetched are left out of the sums.
+func (d *deadLetters) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sources := map[string]int{}
+	var names []string
+	for name, dlqs := range d.targets {
+		names = append(names, name)
+		for _, dlq := range dlqs {
+			sources[dlq]++
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		messages, rate, seen := 0, float32(0), false
+		for _, dlq := range d.targets[name] {
+			if q, ok := d.queues[dlq]; ok {
+				messages += q.messages
+				rate += q.publishRate
+				seen = true
+			}
+		}
+		if !seen {
+			continue
+		}
+		set := d.queues[name].set
+		set.SetMetric("dead_letter_queue_messages", messages, metric.GAUGE)
+		if !d.cfg.LowOverhead {
+			set.SetMetric("dead_letter_queue_publish_rate", rate, metric.GAUGE)
+		}
+	}
+	for name, q := range d.queues {
+		isDLQ := 0
+		if sources[name] > 0 {
+			isDLQ = 1
+			q.set.SetMetric("dead_letter_sources", sources[name], metric.GAUGE)
+		}
+		q.set.SetMetric("is_dead_letter_queue", isDLQ, metric.GAUGE)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.eu.paid", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.paid", true},
+		{"#.paid", "orders.eu.paid", true},
+		{"*.eu.#", "orders.eu", true},
+		{"#", "", true},
+		{"orders", "refunds", false},
+	}
+	for _, c := range cases {
+		if got := topicMatches(strings.Split(c.pattern, "."), strings.Split(c.key, ".")); got != c.match {
+			t.Errorf("%q against %q: got %v", c.pattern, c.key, got)
+		}
+	}
+}
+
+func TestDeadLetterQueues(t *testing.T) {
+	routes := newRouting([]rabbithole.BindingInfo{
+		{Source: "", Vhost: "/", Destination: "orders", DestinationType: "queue", RoutingKey: "orders"},
+		{Source: "shop", Vhost: "/", Destination: "orders", DestinationType: "queue", RoutingKey: "orders.eu.paid"},
+		{Source: "events", Vhost: "/", Destination: "orders", DestinationType: "queue", RoutingKey: "orders.#"},
+		{Source: "", Vhost: "/", Destination: "orders.dlq", DestinationType: "queue", RoutingKey: "orders.dlq"},
+		{Source: "", Vhost: "/", Destination: "orders.eu.paid", DestinationType: "queue", RoutingKey: "orders.eu.paid"},
+		{Source: "dlx", Vhost: "/", Destination: "dead", DestinationType: "exchange", RoutingKey: "#.paid"},
+		{Source: "dlx", Vhost: "/", Destination: "refunds.dlq", DestinationType: "queue", RoutingKey: "refunds.#"},
+		{Source: "dead", Vhost: "/", Destination: "orders.dlq", DestinationType: "queue"},
+	}, []rabbithole.ExchangeInfo{
+		{Name: "dlx", Vhost: "/", Type: "topic"},
+		{Name: "events", Vhost: "/", Type: "topic"},
+		{Name: "dead", Vhost: "/", Type: "fanout"},
+	}, []rabbithole.Policy{
+		{Vhost: "/", Name: "dlx", Definition: rabbithole.PolicyDefinition{"dead-letter-exchange": "dlx", "dead-letter-routing-key": "refunds.eu"}},
+	})
+
+	cases := []struct {
+		name  string
+		queue rabbithole.QueueInfo
+		want  []string
+	}{
+		// without a dead-letter routing key the keys the queue was bound with are used
+		{"arguments", rabbithole.QueueInfo{Name: "orders", Vhost: "/", Arguments: map[string]interface{}{"x-dead-letter-exchange": "dlx"}}, []string{"orders.dlq"}},
+		{"policy", rabbithole.QueueInfo{Name: "orders", Vhost: "/", Policy: "dlx"}, []string{"refunds.dlq"}},
+		{"arguments win over the policy", rabbithole.QueueInfo{Name: "orders", Vhost: "/", Policy: "dlx", Arguments: map[string]interface{}{"x-dead-letter-routing-key": "x.paid"}}, []string{"orders.dlq"}},
+		{"default exchange", rabbithole.QueueInfo{Name: "orders", Vhost: "/", Arguments: map[string]interface{}{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "orders.dlq"}}, []string{"orders.dlq"}},
+		// only the keys that name a queue are routed by the default exchange
+		{"default exchange without a routing key", rabbithole.QueueInfo{Name: "orders", Vhost: "/", Arguments: map[string]interface{}{"x-dead-letter-exchange": ""}}, []string{"orders.eu.paid"}},
+	}
+	for _, c := range cases {
+		target, ok := resolveDeadLetter(c.queue, routes)
+		if !ok {
+			t.Errorf("%s: no dead-letter target", c.name)
+			continue
+		}
+		if got := deadLetterQueues(c.queue, target, routes); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, ok := resolveDeadLetter(rabbithole.QueueInfo{Name: "plain", Vhost: "/"}, routes); ok {
+		t.Error("expected no target for a queue without dead-lettering")
+	}
+}
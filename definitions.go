@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/event"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+// Upper bound on the objects of each kind and change listed in a
+// definitions change event; the rest are only counted.
+const maxListedChanges = 25
+
+// definitionsSnapshot is the broker configuration kept between runs: for
+// each kind of object, the canonical JSON of every object by its key.
+// Password hashes are replaced by a fingerprint, so a password change is
+// seen without the hash being stored.
+type definitionsSnapshot map[string]map[string]string
+
+func (s definitionsSnapshot) add(kind string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s[kind] == nil {
+		s[kind] = map[string]string{}
+	}
+	s[kind][key] = string(b)
+	return nil
+}
+
+// passwordFingerprint identifies a password hash without revealing it.
+func passwordFingerprint(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// normalizeDefinitions builds the snapshot of d. json.Marshal sorts map
+// keys, so arguments and policy definitions compare equal whatever order
+// the broker exports them in.
+func normalizeDefinitions(d *rabbithole.Definitions) (definitionsSnapshot, error) {
+	s := definitionsSnapshot{}
+	for _, u := range d.Users {
+		tags := append([]string{}, u.Tags...)
+		sort.Strings(tags)
+		user := struct {
+			Name                string   `json:"name"`
+			Tags                []string `json:"tags"`
+			HashingAlgorithm    string   `json:"hashing_algorithm,omitempty"`
+			PasswordFingerprint string   `json:"password_fingerprint,omitempty"`
+		}{u.Name, tags, u.HashingAlgorithm, passwordFingerprint(u.PasswordHash)}
+		if err := s.add("users", u.Name, user); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range d.Vhosts {
+		if err := s.add("vhosts", entityKey(v.Name), v); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range d.Permissions {
+		if err := s.add("permissions", entityKey(p.User, p.Vhost), p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range d.Policies {
+		if err := s.add("policies", entityKey(p.Vhost, p.Name), p); err != nil {
+			return nil, err
+		}
+	}
+	for _, q := range d.Queues {
+		if err := s.add("queues", entityKey(q.Vhost, q.Name), q); err != nil {
+			return nil, err
+		}
+	}
+	for _, x := range d.Exchanges {
+		if err := s.add("exchanges", entityKey(x.Vhost, x.Name), x); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range d.Bindings {
+		// Bindings can't be changed, only added and removed, and two of
+		// them may differ only in their arguments.
+		b.PropertiesKey = ""
+		key := entityKey(b.Vhost, b.Source, b.DestinationType, b.Destination, b.RoutingKey)
+		if len(b.Arguments) > 0 {
+			args, err := json.Marshal(b.Arguments)
+			if err != nil {
+				return nil, err
+			}
+			key += "/" + escapeKeyPart(string(args))
+		}
+		if err := s.add("bindings", key, b); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// definitionChanges are the keys of the objects of one kind that were
+// added, removed or modified.
+type definitionChanges struct {
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+}
+
+// diffDefinitions compares two snapshots, by kind, leaving out the kinds
+// that didn't change.
+func diffDefinitions(prev definitionsSnapshot, cur definitionsSnapshot) map[string]*definitionChanges {
+	changes := map[string]*definitionChanges{}
+	changesOf := func(kind string) *definitionChanges {
+		if changes[kind] == nil {
+			changes[kind] = &definitionChanges{}
+		}
+		return changes[kind]
+	}
+	for kind, objects := range cur {
+		for key, v := range objects {
+			old, ok := prev[kind][key]
+			if !ok {
+				changesOf(kind).Added = append(changesOf(kind).Added, key)
+			} else if old != v {
+				changesOf(kind).Modified = append(changesOf(kind).Modified, key)
+			}
+		}
+	}
+	for kind, objects := range prev {
+		for key := range objects {
+			if _, ok := cur[kind][key]; !ok {
+				changesOf(kind).Removed = append(changesOf(kind).Removed, key)
+			}
+		}
+	}
+	for _, c := range changes {
+		sort.Strings(c.Added)
+		sort.Strings(c.Removed)
+		sort.Strings(c.Modified)
+	}
+	return changes
+}
+
+// listChanges caps keys at maxListedChanges, noting how many were left out.
+func listChanges(keys []string) []string {
+	if len(keys) <= maxListedChanges {
+		return keys
+	}
+	return append(keys[:maxListedChanges:maxListedChanges], fmt.Sprintf("... and %d more", len(keys)-maxListedChanges))
+}
+
+// loadDefinitions exports the definitions of the whole cluster, or of
+// each of cfg.DefinitionsVhosts merged together.
+func loadDefinitions(rmqc managementClient, cfg Config) (*rabbithole.Definitions, error) {
+	if len(cfg.DefinitionsVhosts) == 0 {
+		return rmqc.GetDefinitions()
+	}
+	merged := &rabbithole.Definitions{}
+	for _, vhost := range cfg.DefinitionsVhosts {
+		d, err := rmqc.GetDefinitionsIn(vhost)
+		if err != nil {
+			return nil, fmt.Errorf("definitions of vhost %s: %v", vhost, err)
+		}
+		merged.Policies = append(merged.Policies, d.Policies...)
+		merged.Queues = append(merged.Queues, d.Queues...)
+		merged.Exchanges = append(merged.Exchanges, d.Exchanges...)
+		merged.Bindings = append(merged.Bindings, d.Bindings...)
+	}
+	return merged, nil
+}
+
+// populateDefinitions keeps a snapshot of the broker configuration in
+// cfg.State and sends an event listing what was added, removed or
+// modified since the previous run. The first run only takes the snapshot.
+// An unchanged snapshot is only rewritten once it is half as old as
+// persist.DefaultTTL, so it doesn't expire.
+func populateDefinitions(e *integration.Entity, rmqc managementClient, cfg Config) error {
+	d, err := loadDefinitions(rmqc, cfg)
+	if err != nil {
+		return err
+	}
+	cur, err := normalizeDefinitions(d)
+	if err != nil {
+		return err
+	}
+	key := "definitions:" + overviewEntityName(cfg)
+	var prev definitionsSnapshot
+	saved, err := cfg.State.Get(key, &prev)
+	if err != nil {
+		cfg.State.Set(key, cur)
+		return nil
+	}
+
+	changes := diffDefinitions(prev, cur)
+	if len(changes) == 0 {
+		if time.Since(time.Unix(saved, 0)) > persist.DefaultTTL/2 {
+			cfg.State.Set(key, cur)
+		}
+		return nil
+	}
+	cfg.State.Set(key, cur)
+	added, removed, modified := 0, 0, 0
+	for _, c := range changes {
+		added += len(c.Added)
+		removed += len(c.Removed)
+		modified += len(c.Modified)
+		c.Added = listChanges(c.Added)
+		c.Removed = listChanges(c.Removed)
+		c.Modified = listChanges(c.Modified)
+	}
+	listed, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("Broker definitions changed, %d added, %d removed, %d modified: %s", added, removed, modified, listed)
+	return e.AddEvent(event.New(summary, "RabbitMQ"))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestUserTags(t *testing.T) {
+	for _, doc := range []string{`{"tags":"administrator, monitoring"}`, `{"tags":["administrator","monitoring"]}`} {
+		var u rabbithole.UserDefinition
+		if err := json.Unmarshal([]byte(doc), &u); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]string(u.Tags), []string{"administrator", "monitoring"}) {
+			t.Errorf("%s: got tags %q", doc, u.Tags)
+		}
+	}
+}
+
+func TestDefinitionsChangeEvent(t *testing.T) {
+	fake := &fakeManagement{
+		Nodes:       1,
+		Queues:      2,
+		Users:       []rabbithole.UserDefinition{{Name: "alice", PasswordHash: "secret-hash-1", Tags: rabbithole.UserTags{"management"}}},
+		Vhosts:      []rabbithole.VhostDefinition{{Name: "/"}, {Name: "staging"}},
+		Permissions: []rabbithole.PermissionInfo{{User: "alice", Vhost: "/", Configure: ".*", Write: ".*", Read: ".*"}},
+	}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	state := persist.NewInMemoryStore()
+	cfg := Config{Cluster: "c", Workers: 1, State: state}
+
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := overviewEvents(t, payload); len(events) != 0 {
+		t.Errorf("expected no event on the first run, got %q", events)
+	}
+
+	fake.Queues = 3
+	fake.QueueArguments = map[string]map[string]interface{}{"queue-000": {"x-max-length": 10}}
+	fake.Users[0].PasswordHash = "secret-hash-2"
+	fake.Permissions = nil
+	fake.Vhosts = []rabbithole.VhostDefinition{{Name: "/"}, {Name: "test"}}
+	fake.Policies = []rabbithole.Policy{{Vhost: "test", Name: "ttl", Pattern: ".*", ApplyTo: "queues"}}
+	payload, err = runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Broker definitions changed, 3 added, 2 removed, 2 modified: ` +
+		`{"permissions":{"removed":["alice/%2F"]},"policies":{"added":["test/ttl"]},` +
+		`"queues":{"added":["%2F/queue-002"],"modified":["%2F/queue-000"]},"users":{"modified":["alice"]},` +
+		`"vhosts":{"added":["test"],"removed":["staging"]}}`
+	if events := overviewEvents(t, payload); !reflect.DeepEqual(events, []string{want}) {
+		t.Errorf("got events %q", events)
+	}
+
+	payload, err = runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := overviewEvents(t, payload); len(events) != 0 {
+		t.Errorf("expected no event without changes, got %q", events)
+	}
+
+	var snapshot definitionsSnapshot
+	if _, err := state.Get("definitions:c", &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if user := snapshot["users"]["alice"]; user == "" || strings.Contains(user, "secret-hash") {
+		t.Errorf("expected alice's password hash to be redacted, got %s", user)
+	}
+}
+
+func TestDefinitionsPerVhost(t *testing.T) {
+	fake := &fakeManagement{
+		Nodes:  1,
+		Queues: 4,
+		Users:  []rabbithole.UserDefinition{{Name: "alice"}},
+	}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	state := persist.NewInMemoryStore()
+	cfg := Config{Cluster: "c", Workers: 1, State: state, DefinitionsVhosts: []string{"test"}}
+
+	if _, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot definitionsSnapshot
+	if _, err := state.Get("definitions:c", &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var queues []string
+	for key := range snapshot["queues"] {
+		queues = append(queues, key)
+	}
+	if len(queues) != 2 || snapshot["queues"]["test/queue-001"] == "" || snapshot["queues"]["test/queue-003"] == "" {
+		t.Errorf("expected the queues of vhost test, got %v", queues)
+	}
+	if len(snapshot["users"]) != 0 {
+		t.Errorf("expected no users in a vhost export, got %v", snapshot["users"])
+	}
+}
+
+func TestDefinitionsUnauthorized(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1, Status: map[string]int{"/api/definitions": 401}}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	state := persist.NewInMemoryStore()
+	cfg := Config{Cluster: "c", Workers: 1, State: state}
+
+	if _, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{}); err != nil {
+		t.Fatalf("a user without the administrator tag should still be collected: %v", err)
+	}
+	var snapshot definitionsSnapshot
+	if _, err := state.Get("definitions:c", &snapshot); err != persist.ErrNotFound {
+		t.Errorf("expected no snapshot, got %v", err)
+	}
+}
+
+// countingStore counts the writes of each key.
+type countingStore struct {
+	persist.Storer
+	mu   sync.Mutex
+	sets map[string]int
+}
+
+func (s *countingStore) Set(key string, value interface{}) int64 {
+	s.mu.Lock()
+	s.sets[key]++
+	s.mu.Unlock()
+	return s.Storer.Set(key, value)
+}
+
+func TestDefinitionsSnapshotWrittenOnChange(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1, Queues: 2}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	state := &countingStore{Storer: persist.NewInMemoryStore(), sets: map[string]int{}}
+	cfg := Config{Cluster: "c", Workers: 1, State: state}
+
+	// taken, unchanged twice, then a queue is added
+	for n, want := range []int{1, 1, 1, 2} {
+		if n == 3 {
+			fake.Queues = 3
+		}
+		if _, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{}); err != nil {
+			t.Fatal(err)
+		}
+		if got := state.sets["definitions:c"]; got != want {
+			t.Errorf("run %d: snapshot written %d times, expected %d", n, got, want)
+		}
+	}
+}
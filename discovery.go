@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infra-integrations-sdk/data/attribute"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/log"
+)
+
+// Where a pod's service account credentials are mounted.
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// discoveredEndpoint is a management API found through Kubernetes.
+type discoveredEndpoint struct {
+	// Name of the pod or service.
+	Name string
+	URL  string
+}
+
+// discoveredCluster groups the endpoints that share a cluster label value
+// within a namespace. Every endpoint serves the same cluster-wide data.
+type discoveredCluster struct {
+	Name      string
+	Namespace string
+	Endpoints []discoveredEndpoint
+}
+
+// k8sObjectList is the subset of a Kubernetes PodList or ServiceList that
+// discovery reads.
+type k8sObjectList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			// pods
+			Containers []struct {
+				Ports []struct {
+					Name          string `json:"name"`
+					ContainerPort int    `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+			// services
+			ClusterIP string `json:"clusterIP"`
+			Ports     []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// kubernetesClient returns the API server address and an HTTP client that
+// trusts its CA. Outside a cluster both can be set in the configuration.
+func kubernetesClient(cfg Config) (string, *http.Client, error) {
+	server := cfg.K8sAPIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return "", nil, fmt.Errorf("RMQ_DISCOVERY=kubernetes needs RMQ_K8S_API_SERVER outside a cluster")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	caFile := cfg.K8sCAFile
+	if caFile == "" && cfg.K8sAPIServer == "" {
+		caFile = serviceAccountCAFile
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return "", nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return strings.TrimRight(server, "/"), &http.Client{Transport: transport}, nil
+}
+
+// discoverKubernetes lists the pods or services matching the label
+// selector and groups them into clusters by the cluster label.
+func discoverKubernetes(ctx context.Context, cfg Config) ([]discoveredCluster, error) {
+	server, httpc, err := kubernetesClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tokenFile := cfg.K8sTokenFile
+	if tokenFile == "" {
+		tokenFile = serviceAccountTokenFile
+	}
+	token, err := readSecretFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/api/v1/" + cfg.K8sKind
+	if cfg.K8sNamespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(cfg.K8sNamespace) + "/" + cfg.K8sKind
+	}
+	req, err := http.NewRequest("GET", server+path+"?"+url.Values{"labelSelector": {cfg.K8sLabelSelector}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	res, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("Error %d from Kubernetes listing %s: %s", res.StatusCode, cfg.K8sKind, strings.TrimSpace(string(body)))
+	}
+	var list k8sObjectList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	clusters := map[string]*discoveredCluster{}
+	for _, item := range list.Items {
+		name := item.Metadata.Labels[cfg.K8sClusterLabel]
+		if name == "" {
+			name = item.Metadata.Name
+		}
+
+		host, port := "", cfg.K8sManagementPort
+		if cfg.K8sKind == "services" {
+			host = item.Spec.ClusterIP
+			for _, p := range item.Spec.Ports {
+				if p.Name == "management" {
+					port = p.Port
+				}
+			}
+		} else {
+			if item.Status.Phase != "Running" {
+				continue
+			}
+			host = item.Status.PodIP
+			for _, c := range item.Spec.Containers {
+				for _, p := range c.Ports {
+					if p.Name == "management" {
+						port = p.ContainerPort
+					}
+				}
+			}
+		}
+		if host == "" || host == "None" {
+			continue
+		}
+
+		key := item.Metadata.Namespace + "/" + name
+		c, ok := clusters[key]
+		if !ok {
+			c = &discoveredCluster{Name: name, Namespace: item.Metadata.Namespace}
+			clusters[key] = c
+		}
+		c.Endpoints = append(c.Endpoints, discoveredEndpoint{
+			Name: item.Metadata.Name,
+			URL:  cfg.K8sScheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)),
+		})
+	}
+
+	var keys []string
+	for key := range clusters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	discovered := make([]discoveredCluster, 0, len(keys))
+	for _, key := range keys {
+		c := clusters[key]
+		sort.Slice(c.Endpoints, func(a, b int) bool { return c.Endpoints[a].Name < c.Endpoints[b].Name })
+		discovered = append(discovered, *c)
+	}
+	return discovered, nil
+}
+
+// podTags returns a NodeTags that tags a node with the pod it runs in: the
+// pod whose name or IP is the host in the node name, as in
+// rabbit@orders-server-0.orders-nodes.shop or rabbit@10.4.0.12.
+func podTags(endpoints []discoveredEndpoint) func(node string) []attribute.Attribute {
+	pods := map[string]string{}
+	for _, endpoint := range endpoints {
+		pods[endpoint.Name] = endpoint.Name
+		if u, err := url.Parse(endpoint.URL); err == nil {
+			pods[u.Hostname()] = endpoint.Name
+		}
+	}
+	return func(node string) []attribute.Attribute {
+		host := node[strings.Index(node, "@")+1:]
+		pod, ok := pods[host]
+		if !ok {
+			pod, ok = pods[strings.SplitN(host, ".", 2)[0]]
+		}
+		if !ok {
+			return nil
+		}
+		return []attribute.Attribute{attribute.Attr("k8s.pod", pod)}
+	}
+}
+
+// collectDiscovered collects every discovered cluster through the first
+// of its endpoints that answers. A cluster that can't be collected is
+// logged and skipped so the others are still reported.
+func collectDiscovered(ctx context.Context, i *integration.Integration, cfg Config, args argumentList) error {
+	clusters, err := discoverKubernetes(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if len(clusters) == 0 {
+		log.Warn("No RabbitMQ %s match %q", cfg.K8sKind, cfg.K8sLabelSelector)
+	}
+	for _, c := range clusters {
+		if err := collectDiscoveredCluster(ctx, i, cfg, args, c); err != nil {
+			log.Error("Collecting cluster %s in namespace %s: %v", c.Name, c.Namespace, err)
+		}
+	}
+	return nil
+}
+
+func collectDiscoveredCluster(ctx context.Context, i *integration.Integration, cfg Config, args argumentList, c discoveredCluster) error {
+	var lastErr error
+	for _, endpoint := range c.Endpoints {
+		ccfg := cfg
+		ccfg.Host = endpoint.URL
+		// The same cluster label value can be used in several namespaces,
+		// so the namespace is part of the identity that entity names and
+		// kept state are keyed on.
+		ccfg.Cluster = c.Namespace + "/" + c.Name
+		// Prometheus endpoints are configured per cluster, so discovered
+		// clusters always use the management API.
+		ccfg.Source = "management"
+		ccfg.Tags = append(append([]attribute.Attribute(nil), cfg.Tags...),
+			attribute.Attr("k8s.namespace", c.Namespace),
+			attribute.Attr("cluster", c.Name),
+		)
+		// Every pod serves the whole cluster's data, so only a node's
+		// own metrics are tagged with a pod.
+		if cfg.K8sKind != "services" {
+			ccfg.NodeTags = podTags(c.Endpoints)
+		}
+		rmqc, err := rmqClient(ccfg)
+		if err != nil {
+			return err
+		}
+
+		// check the endpoint answers before anything is reported from it
+		probe, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+		_, err = probe.Overview()
+		cancel()
+		if err != nil {
+			log.Warn("Skipping %s (%s): %v", endpoint.Name, endpoint.URL, err)
+			lastErr = err
+			continue
+		}
+		return collect(ctx, i, rmqc, ccfg, args)
+	}
+	if lastErr == nil {
+		return fmt.Errorf("no endpoints")
+	}
+	return lastErr
+}
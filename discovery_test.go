@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+type fakePod struct {
+	Name, Namespace, Cluster, Phase string
+	// Management is the server the pod's management port points at.
+	Management *httptest.Server
+}
+
+// newFakeKubernetes serves a pod list for the label selector
+// app.kubernetes.io/component=rabbitmq to requests carrying token.
+func newFakeKubernetes(token string, pods []fakePod) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"kind": "Status", "message": "Unauthorized"})
+			return
+		}
+		if r.URL.Query().Get("labelSelector") != "app.kubernetes.io/component=rabbitmq" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{}})
+			return
+		}
+		namespace := ""
+		if strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/") {
+			namespace = strings.Split(r.URL.Path, "/")[4]
+		} else if r.URL.Path != "/api/v1/pods" {
+			http.NotFound(w, r)
+			return
+		}
+
+		var items []interface{}
+		for _, pod := range pods {
+			if namespace != "" && pod.Namespace != namespace {
+				continue
+			}
+			u, _ := url.Parse(pod.Management.URL)
+			host, port, _ := net.SplitHostPort(u.Host)
+			containerPort, _ := strconv.Atoi(port)
+			items = append(items, map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":      pod.Name,
+					"namespace": pod.Namespace,
+					"labels": map[string]string{
+						"app.kubernetes.io/component": "rabbitmq",
+						"app.kubernetes.io/name":      pod.Cluster,
+					},
+				},
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{
+						"ports": []interface{}{
+							map[string]interface{}{"name": "amqp", "containerPort": 5672},
+							map[string]interface{}{"name": "management", "containerPort": containerPort},
+						},
+					}},
+				},
+				"status": map[string]interface{}{"phase": pod.Phase, "podIP": host},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "PodList", "items": items})
+	}))
+}
+
+func discoveryConfig(t *testing.T, server string) (Config, func()) {
+	f, err := ioutil.TempFile("", "k8s-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("sa-token\n")
+	f.Close()
+	cfg := Config{
+		Discovery:         "kubernetes",
+		K8sKind:           "pods",
+		K8sLabelSelector:  "app.kubernetes.io/component=rabbitmq",
+		K8sClusterLabel:   "app.kubernetes.io/name",
+		K8sManagementPort: 15672,
+		K8sScheme:         "http",
+		K8sAPIServer:      server,
+		K8sTokenFile:      f.Name(),
+		Workers:           1,
+	}
+	return cfg, func() { os.Remove(f.Name()) }
+}
+
+func TestDiscoverKubernetes(t *testing.T) {
+	orders := newFakeManagement(&fakeManagement{Nodes: 2})
+	defer orders.Close()
+	billing := newFakeManagement(&fakeManagement{Nodes: 1})
+	defer billing.Close()
+	k8s := newFakeKubernetes("sa-token", []fakePod{
+		{Name: "orders-server-1", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+		{Name: "orders-server-0", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+		{Name: "orders-server-2", Namespace: "shop", Cluster: "orders", Phase: "Pending", Management: orders},
+		{Name: "billing-server-0", Namespace: "finance", Cluster: "billing", Phase: "Running", Management: billing},
+	})
+	defer k8s.Close()
+
+	cfg, cleanup := discoveryConfig(t, k8s.URL)
+	defer cleanup()
+	clusters, err := discoverKubernetes(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %+v", clusters)
+	}
+	if c := clusters[0]; c.Name != "billing" || c.Namespace != "finance" || len(c.Endpoints) != 1 || c.Endpoints[0].URL != billing.URL {
+		t.Errorf("unexpected cluster %+v", c)
+	}
+	if c := clusters[1]; c.Name != "orders" || len(c.Endpoints) != 2 || c.Endpoints[0].Name != "orders-server-0" {
+		t.Errorf("expected the two running orders pods in order, got %+v", c)
+	}
+
+	cfg.K8sNamespace = "shop"
+	if clusters, err = discoverKubernetes(context.Background(), cfg); err != nil || len(clusters) != 1 {
+		t.Errorf("expected only the shop namespace, got %+v %v", clusters, err)
+	}
+
+	cfg.K8sTokenFile = cfg.K8sTokenFile + ".missing"
+	if _, err := discoverKubernetes(context.Background(), cfg); err == nil {
+		t.Error("expected a missing token to fail")
+	}
+}
+
+func TestCollectDiscovered(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "unavailable"})
+	}))
+	defer down.Close()
+	orders := newFakeManagement(&fakeManagement{Nodes: 1, Queues: 2})
+	defer orders.Close()
+	k8s := newFakeKubernetes("sa-token", []fakePod{
+		{Name: "orders-server-0", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: down},
+		{Name: "orders-server-1", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+	})
+	defer k8s.Close()
+
+	cfg, cleanup := discoveryConfig(t, k8s.URL)
+	defer cleanup()
+	// The first pod is down, so the cluster is collected through the second.
+	payload, err := runIntegration(t, func(i *integration.Integration) error {
+		return collectDiscovered(context.Background(), i, cfg, argumentList{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "kubernetes_discovery", payload)
+}
+
+func TestCollectDiscoveredTagsEachNodeWithItsPod(t *testing.T) {
+	orders := newFakeManagement(&fakeManagement{Nodes: 3, Queues: 2})
+	defer orders.Close()
+	// Every pod serves the same cluster, whose nodes are named after them.
+	k8s := newFakeKubernetes("sa-token", []fakePod{
+		{Name: "node-0", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+		{Name: "node-1", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+		{Name: "node-2", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: orders},
+	})
+	defer k8s.Close()
+
+	cfg, cleanup := discoveryConfig(t, k8s.URL)
+	defer cleanup()
+	payload, err := runIntegration(t, func(i *integration.Integration) error {
+		return collectDiscovered(context.Background(), i, cfg, argumentList{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Data []struct {
+			Entity struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"entity"`
+			Metrics []map[string]interface{} `json:"metrics"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	nodes := 0
+	for _, e := range doc.Data {
+		for _, ms := range e.Metrics {
+			pod, tagged := ms["k8s.pod"]
+			if e.Entity.Type != "node" {
+				if tagged {
+					t.Errorf("%s %s: cluster-wide metrics tagged with pod %v", e.Entity.Type, e.Entity.Name, pod)
+				}
+				continue
+			}
+			nodes++
+			if want := strings.TrimPrefix(e.Entity.Name, "shop%2Forders/rabbit@"); pod != want {
+				t.Errorf("node %s: expected k8s.pod %s, got %v", e.Entity.Name, want, pod)
+			}
+		}
+	}
+	if nodes != 3 {
+		t.Errorf("expected 3 node metric sets, got %d", nodes)
+	}
+}
+
+func TestPodTags(t *testing.T) {
+	tags := podTags([]discoveredEndpoint{
+		{Name: "orders-server-0", URL: "http://10.4.0.11:15672"},
+		{Name: "orders-server-1", URL: "http://10.4.0.12:15672"},
+	})
+	for node, want := range map[string]string{
+		"rabbit@orders-server-0.orders-nodes.shop": "orders-server-0",
+		"rabbit@orders-server-1":                   "orders-server-1",
+		"rabbit@10.4.0.12":                         "orders-server-1",
+		"rabbit@orders-server-2.orders-nodes.shop": "",
+	} {
+		got := ""
+		for _, tag := range tags(node) {
+			if tag.Key == "k8s.pod" {
+				got = tag.Value
+			}
+		}
+		if got != want {
+			t.Errorf("%s: expected pod %q, got %q", node, want, got)
+		}
+	}
+}
+
+func TestCollectDiscoveredSameNameInTwoNamespaces(t *testing.T) {
+	shop := newFakeManagement(&fakeManagement{Nodes: 1, Queues: 2})
+	defer shop.Close()
+	staging := newFakeManagement(&fakeManagement{Nodes: 1, Queues: 3})
+	defer staging.Close()
+	k8s := newFakeKubernetes("sa-token", []fakePod{
+		{Name: "orders-server-0", Namespace: "shop", Cluster: "orders", Phase: "Running", Management: shop},
+		{Name: "orders-server-0", Namespace: "staging", Cluster: "orders", Phase: "Running", Management: staging},
+	})
+	defer k8s.Close()
+
+	cfg, cleanup := discoveryConfig(t, k8s.URL)
+	defer cleanup()
+	state := persist.NewInMemoryStore()
+	cfg.State = state
+	payload, err := runIntegration(t, func(i *integration.Integration) error {
+		return collectDiscovered(context.Background(), i, cfg, argumentList{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntities(t, payload, "cluster_overview"); n != 2 {
+		t.Errorf("expected an overview for each namespace, got %d", n)
+	}
+	if n := countEntities(t, payload, "queue"); n != 5 {
+		t.Errorf("expected the queues of both clusters, got %d", n)
+	}
+	for _, key := range []string{"definitions:shop%2Forders", "definitions:staging%2Forders"} {
+		var snapshot definitionsSnapshot
+		if _, err := state.Get(key, &snapshot); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/newrelic/infra-integrations-sdk/log"
+)
+
+// Entity names are keys built from the cluster identity and the object's
+// own identity, joined with "/":
+//
+//	cluster_overview  <cluster>
+//	node              <cluster>/<node>
+//	queue             <cluster>/<vhost>/<queue>
+//	exchange          <cluster>/<vhost>/<exchange>
+//	vhost             <cluster>/<vhost>
+//	user              <cluster>/<user>
+//
+// Each part is escaped with escapeKeyPart, so the default vhost "/" becomes
+// "%2F" and a key always splits back into the same parts. With
+// RMQ_LEGACY_ENTITY_NAMES the names used before cluster identities were
+// added are kept instead: <node>, <vhost>/<queue> and so on.
+
+// escapeKeyPart percent-encodes the characters that would make a key
+// ambiguous: "%" itself and the "/" separator.
+func escapeKeyPart(s string) string {
+	s = strings.Replace(s, "%", "%25", -1)
+	return strings.Replace(s, "/", "%2F", -1)
+}
+
+func entityKey(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for n, part := range parts {
+		escaped[n] = escapeKeyPart(part)
+	}
+	return strings.Join(escaped, "/")
+}
+
+func overviewEntityName(cfg Config) string {
+	if cfg.LegacyEntityNames {
+		return cfg.Cluster
+	}
+	return entityKey(cfg.Cluster)
+}
+
+func nodeEntityName(cfg Config, node string) string {
+	if cfg.LegacyEntityNames {
+		return node
+	}
+	return entityKey(cfg.Cluster, node)
+}
+
+func queueEntityName(cfg Config, vhost string, name string) string {
+	if cfg.LegacyEntityNames {
+		return vhost + "/" + name
+	}
+	return entityKey(cfg.Cluster, vhost, name)
+}
+
+// noQueuesEntityName names the placeholder queue entity reported when the
+// cluster has no queues.
+func noQueuesEntityName(cfg Config) string {
+	if cfg.LegacyEntityNames {
+		return cfg.Cluster + "/no_queues"
+	}
+	return entityKey(cfg.Cluster) + "/no_queues"
+}
+
+// exchangeEntityName names an exchange, reporting the nameless default
+// exchange as amq.default.
+func exchangeEntityName(cfg Config, vhost string, name string) string {
+	if name == "" {
+		name = "amq.default"
+	}
+	if cfg.LegacyEntityNames {
+		return vhost + "/" + name
+	}
+	return entityKey(cfg.Cluster, vhost, name)
+}
+
+func vhostEntityName(cfg Config, vhost string) string {
+	if cfg.LegacyEntityNames {
+		return vhost
+	}
+	return entityKey(cfg.Cluster, vhost)
+}
+
+func userEntityName(cfg Config, user string) string {
+	if cfg.LegacyEntityNames {
+		return user
+	}
+	return entityKey(cfg.Cluster, user)
+}
+
+// clusterIdentity returns RMQ_CLUSTER, or else the cluster name the
+// broker reports, so entities from different clusters never share a name.
+// When the name can't be read, e.g. a Prometheus-only setup without
+// management API access, the host of RMQ_HOSTNAME is used.
+func clusterIdentity(ctx context.Context, rmqc managementClient, cfg Config) string {
+	if cfg.Cluster != "" || cfg.LegacyEntityNames {
+		return cfg.Cluster
+	}
+	budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+	defer cancel()
+	cn, err := budgeted.GetClusterName()
+	if err == nil && cn.Name != "" {
+		return cn.Name
+	}
+	if err == nil {
+		err = fmt.Errorf("the broker reported an empty name")
+	}
+	host := cfg.Host
+	if u, perr := url.Parse(cfg.Host); perr == nil && u.Host != "" {
+		host = u.Host
+	}
+	log.Warn("Using %s as the cluster identity, set RMQ_CLUSTER to choose one: cluster name not available: %v", host, err)
+	return host
+}
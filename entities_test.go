@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestEntityNames(t *testing.T) {
+	cfg := Config{Cluster: "eu/prod"}
+	legacy := Config{Cluster: "eu/prod", LegacyEntityNames: true}
+	cases := []struct{ got, want string }{
+		{overviewEntityName(cfg), "eu%2Fprod"},
+		{nodeEntityName(cfg, "rabbit@node-0"), "eu%2Fprod/rabbit@node-0"},
+		{queueEntityName(cfg, "/", "orders"), "eu%2Fprod/%2F/orders"},
+		{queueEntityName(cfg, "/", "orders/eu"), "eu%2Fprod/%2F/orders%2Feu"},
+		{queueEntityName(cfg, "50%", "a%2Fb"), "eu%2Fprod/50%25/a%252Fb"},
+		{exchangeEntityName(cfg, "/", ""), "eu%2Fprod/%2F/amq.default"},
+		{noQueuesEntityName(cfg), "eu%2Fprod/no_queues"},
+		{overviewEntityName(legacy), "eu/prod"},
+		{nodeEntityName(legacy, "rabbit@node-0"), "rabbit@node-0"},
+		{queueEntityName(legacy, "/", "orders"), "//orders"},
+		{exchangeEntityName(legacy, "/", ""), "//amq.default"},
+		{noQueuesEntityName(legacy), "eu/prod/no_queues"},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("got %q, want %q", c.got, c.want)
+		}
+	}
+}
+
+func TestClusterIdentity(t *testing.T) {
+	orders := newFakeManagement(&fakeManagement{Nodes: 1, ClusterName: "orders"})
+	defer orders.Close()
+	cfg := Config{Host: orders.URL}
+	if got := clusterIdentity(context.Background(), newTestClient(t, orders.URL), cfg); got != "orders" {
+		t.Errorf("expected the broker's cluster name, got %q", got)
+	}
+
+	cfg.Cluster = "configured"
+	if got := clusterIdentity(context.Background(), newTestClient(t, orders.URL), cfg); got != "configured" {
+		t.Errorf("expected RMQ_CLUSTER to win, got %q", got)
+	}
+
+	forbidden := newFakeManagement(&fakeManagement{Nodes: 1, Status: map[string]int{"/api/cluster-name/": 403}})
+	defer forbidden.Close()
+	u, _ := url.Parse(forbidden.URL)
+	cfg = Config{Host: forbidden.URL}
+	if got := clusterIdentity(context.Background(), newTestClient(t, forbidden.URL), cfg); got != u.Host {
+		t.Errorf("expected the host %q as a fallback, got %q", u.Host, got)
+	}
+}
+
+func TestEntitiesDoNotCollideAcrossClusters(t *testing.T) {
+	names := map[string]bool{}
+	for _, clusterName := range []string{"rabbit@a", "rabbit@b"} {
+		fake := newFakeManagement(&fakeManagement{Nodes: 1, Queues: 2, ClusterName: clusterName})
+		payload, err := runCollect(t, newTestClient(t, fake.URL), Config{Host: fake.URL, Workers: 1}, argumentList{})
+		fake.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range entityNames(t, payload) {
+			if names[name] {
+				t.Errorf("entity %s reported by both clusters", name)
+			}
+			names[name] = true
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+// fakeManagement models the parts of the RabbitMQ management API the
+// integration reads. Data is generated from the counts so every run of a
+// test sees the same broker. Like RabbitMQ, list endpoints only return the
+// fields named by a columns parameter, and /api/queues leaves out the
+// stats DB fields when disable_stats is set.
+type fakeManagement struct {
+	// Nodes is the cluster size; the last Stopped nodes are reported as
+	// not running.
+	Nodes   int
+	Stopped int
+	// Partitions lists, by node name, the peers a node reports as partitioned.
+	Partitions map[string][]string
+	// ClusterName is served by /api/cluster-name, defaulting to the first
+	// node's name as RabbitMQ does.
+	ClusterName string
+	// Queues is spread across the "/" and "test" vhosts and served in
+	// pages like the real /api/queues, PageSize (default 100) at a time
+	// unless the request asks for a page_size.
+	Queues    int
+	PageSize  int
+	Exchanges int
+	// DropUnroutable is the rate of unroutable messages dropped, reported
+	// by /api/overview with a total of 100 times the rate.
+	DropUnroutable float32
+	// Bindings are served by /api/bindings after the default exchange's
+	// binding of every queue, as RabbitMQ lists them, and Policies as is
+	// by /api/policies.
+	Bindings []rabbithole.BindingInfo
+	Policies []rabbithole.Policy
+	// OperatorPolicies is served by /api/operator-policies, or a 404 like
+	// RabbitMQ 3.6 when nil.
+	OperatorPolicies []rabbithole.Policy
+	// QueueArguments, QueuePolicies and QueueOperatorPolicies set the
+	// arguments, policy and operator policy of queues by name.
+	QueueArguments        map[string]map[string]interface{}
+	QueuePolicies         map[string]string
+	QueueOperatorPolicies map[string]string
+	// QueueHeadTimestamps and QueueIdleSince set the head_message_timestamp
+	// and idle_since of queues by name.
+	QueueHeadTimestamps map[string]int64
+	QueueIdleSince      map[string]string
+	// Users, Vhosts and Permissions are exported by /api/definitions
+	// along with the queues, exchanges, bindings and policies above.
+	Users       []rabbithole.UserDefinition
+	Vhosts      []rabbithole.VhostDefinition
+	Permissions []rabbithole.PermissionInfo
+	// VhostLimits is served by /api/vhost-limits, and UserLimits by
+	// /api/user-limits or a 404 like RabbitMQ before 3.8.10 when nil.
+	VhostLimits []rabbithole.VhostLimitsInfo
+	UserLimits  []rabbithole.UserLimitsInfo
+	// Clients are the connections served in pages by /api/connections.
+	Clients []rabbithole.ConnectionInfo
+	// Delay is added before every response.
+	Delay time.Duration
+	// Status forces a response code for a path, e.g. "/api/overview": 503.
+	Status map[string]int
+	// Token, when set, is the only bearer token accepted. Anything else
+	// gets a 401 like the OAuth 2 backend returns.
+	Token string
+	// Failures makes a path return 503 that many times before it is served.
+	Failures map[string]int
+	// QueueFailures makes a page of /api/queues return 503 that many times
+	// before it is served.
+	QueueFailures map[int]int
+
+	mu          sync.Mutex
+	requests    []string
+	connections int
+}
+
+func newFakeManagement(f *fakeManagement) *httptest.Server {
+	srv := httptest.NewUnstartedServer(f)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+		}
+	}
+	srv.Start()
+	return srv
+}
+
+// Connections returns the number of connections accepted so far.
+func (f *fakeManagement) Connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections
+}
+
+// Requests returns the request URIs served so far, in order.
+func (f *fakeManagement) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeManagement) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	authorized := f.Token == "" || r.Header.Get("Authorization") == "Bearer "+f.Token
+	failPage := false
+	if f.Failures[r.URL.Path] > 0 {
+		f.Failures[r.URL.Path]--
+		failPage = true
+	} else if r.URL.Path == "/api/queues" {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if f.QueueFailures[page] > 0 {
+			f.QueueFailures[page]--
+			failPage = true
+		}
+	}
+	f.mu.Unlock()
+
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if !authorized {
+		writeJSON(w, http.StatusUnauthorized, rabbithole.ErrorResponse{Message: "not_authorised", Reason: "Not_Authorized"})
+		return
+	}
+	if status, ok := f.Status[r.URL.Path]; ok {
+		writeJSON(w, status, rabbithole.ErrorResponse{Message: http.StatusText(status), Reason: "fake failure"})
+		return
+	}
+	if failPage {
+		writeJSON(w, http.StatusServiceUnavailable, rabbithole.ErrorResponse{Message: "Service Unavailable", Reason: "fake transient failure"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/overview":
+		writeJSON(w, http.StatusOK, f.overview(r))
+	case "/api/nodes":
+		writeJSON(w, http.StatusOK, f.nodes())
+	case "/api/bindings", "/api/bindings/":
+		bs := []rabbithole.BindingInfo{}
+		for n := 0; n < f.Queues; n++ {
+			q := f.queue(n)
+			bs = append(bs, rabbithole.BindingInfo{Vhost: q.Vhost, Destination: q.Name, DestinationType: "queue", RoutingKey: q.Name, PropertiesKey: q.Name})
+		}
+		bs = append(bs, f.Bindings...)
+		writeJSON(w, http.StatusOK, bs)
+	case "/api/policies", "/api/policies/":
+		ps := f.Policies
+		if ps == nil {
+			ps = []rabbithole.Policy{}
+		}
+		writeJSON(w, http.StatusOK, ps)
+	case "/api/operator-policies", "/api/operator-policies/":
+		if f.OperatorPolicies == nil {
+			writeJSON(w, http.StatusNotFound, rabbithole.ErrorResponse{Message: "Object Not Found", Reason: "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, f.OperatorPolicies)
+	case "/api/cluster-name", "/api/cluster-name/":
+		name := f.ClusterName
+		if name == "" {
+			name = "rabbit@node-0"
+		}
+		writeJSON(w, http.StatusOK, rabbithole.ClusterName{Name: name})
+	case "/api/definitions", "/api/definitions/":
+		writeJSON(w, http.StatusOK, f.definitions(""))
+	case "/api/queues":
+		writeJSON(w, http.StatusOK, f.queuePage(r))
+	case "/api/vhost-limits", "/api/vhost-limits/":
+		ls := f.VhostLimits
+		if ls == nil {
+			ls = []rabbithole.VhostLimitsInfo{}
+		}
+		writeJSON(w, http.StatusOK, ls)
+	case "/api/user-limits", "/api/user-limits/":
+		if f.UserLimits == nil {
+			writeJSON(w, http.StatusNotFound, rabbithole.ErrorResponse{Message: "Object Not Found", Reason: "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, f.UserLimits)
+	case "/api/connections":
+		items := make([]interface{}, len(f.Clients))
+		for n := range f.Clients {
+			items[n] = f.Clients[n]
+		}
+		writeJSON(w, http.StatusOK, f.page(r, items))
+	case "/api/exchanges":
+		xs := f.exchanges()
+		if r.URL.Query().Get("page") == "" {
+			writeJSON(w, http.StatusOK, xs)
+			return
+		}
+		items := make([]interface{}, len(xs))
+		for n := range xs {
+			items[n] = xs[n]
+		}
+		writeJSON(w, http.StatusOK, f.page(r, items))
+	default:
+		if vhost := strings.TrimPrefix(r.URL.Path, "/api/definitions/"); vhost != r.URL.Path {
+			writeJSON(w, http.StatusOK, f.definitions(vhost))
+			return
+		}
+		if vhost := strings.TrimPrefix(r.URL.Path, "/api/queues/"); vhost != r.URL.Path {
+			var items []interface{}
+			for n := 0; n < f.Queues; n++ {
+				if q := f.queue(n); q.Vhost == vhost {
+					items = append(items, q)
+				}
+			}
+			writeJSON(w, http.StatusOK, f.page(r, items))
+			return
+		}
+		writeJSON(w, http.StatusNotFound, rabbithole.ErrorResponse{Message: "Object Not Found", Reason: "Not Found"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// samples returns a window of five samples ending at a fixed time, newest
+// first as the management API orders them.
+func samples(start, step int64) []rabbithole.RateDetailSample {
+	var xs []rabbithole.RateDetailSample
+	for n := int64(4); n >= 0; n-- {
+		xs = append(xs, rabbithole.RateDetailSample{Sample: start + n*step, Timestamp: 1500000000000 + n*5000})
+	}
+	return xs
+}
+
+func (f *fakeManagement) queue(n int) rabbithole.QueueInfo {
+	vhost := "/"
+	if n%2 == 1 {
+		vhost = "test"
+	}
+	q := rabbithole.QueueInfo{
+		Name:                   fmt.Sprintf("queue-%03d", n),
+		Vhost:                  vhost,
+		Node:                   "rabbit@node-0",
+		Consumers:              n % 3,
+		Messages:               n * 2,
+		MessagesReady:          n,
+		MessagesUnacknowledged: n,
+		MessagesDetails:        rabbithole.RateDetails{Rate: float32(n) * 0.5},
+		MessagesBytes:          int64(n) * 2048,
+		MessagesBytesReady:     int64(n) * 1024,
+	}
+	q.Arguments = f.QueueArguments[q.Name]
+	q.Policy = f.QueuePolicies[q.Name]
+	q.OperatorPolicy = f.QueueOperatorPolicies[q.Name]
+	q.HeadMessageTimestamp = rabbithole.Timestamp(f.QueueHeadTimestamps[q.Name])
+	q.IdleSince = f.QueueIdleSince[q.Name]
+	if f.Nodes > 0 {
+		q.Node = fmt.Sprintf("rabbit@node-%d", n%f.Nodes)
+	}
+	return q
+}
+
+func (f *fakeManagement) overview(r *http.Request) rabbithole.Overview {
+	o := rabbithole.Overview{
+		ManagementVersion: "3.7.8",
+		RabbitMQVersion:   "3.7.8",
+		Node:              "rabbit@node-0",
+	}
+	o.ObjectTotals = rabbithole.ObjectTotals{
+		Queues:      f.Queues,
+		Exchanges:   f.Exchanges,
+		Connections: 4,
+		Channels:    8,
+		Consumers:   2,
+	}
+	for n := 0; n < f.Queues; n++ {
+		q := f.queue(n)
+		o.QueueTotals.Messages += q.Messages
+		o.QueueTotals.MessagesReady += q.MessagesReady
+		o.QueueTotals.MessagesUnacknowledged += q.MessagesUnacknowledged
+	}
+	o.MessageStats.PublishDetails.Rate = 2.5
+	o.MessageStats.DeliverDetails.Rate = 1.5
+	o.MessageStats.DeliverGetDetails.Rate = 1.75
+	o.MessageStats.GetDetails.Rate = 0.25
+	o.MessageStats.AckDetails.Rate = 1.25
+	o.MessageStats.ConfirmDetails.Rate = 2.5
+	o.MessageStats.RedeliverDetails.Rate = 0.5
+	o.MessageStats.DiskWritesDetails.Rate = 0.75
+	o.ChurnRates.ConnectionCreatedDetails.Rate = 0.5
+	o.ChurnRates.ConnectionClosedDetails.Rate = 0.25
+	o.ChurnRates.QueueDeclaredDetails.Rate = 1
+	o.MessageStats.DropUnroutable = int64(f.DropUnroutable * 100)
+	o.MessageStats.DropUnroutableDetails.Rate = f.DropUnroutable
+	if r.URL.Query().Get("lengths_age") != "" {
+		o.QueueTotals.MessagesDetails.Samples = samples(10, 5)
+		o.QueueTotals.MessagesReadyDetails.Samples = samples(4, 2)
+		o.QueueTotals.MessagesUnacknowledgedDetails.Samples = samples(6, 3)
+	}
+	if r.URL.Query().Get("msg_rates_age") != "" {
+		o.MessageStats.PublishDetails.Samples = samples(1000, 50)
+		o.MessageStats.DeliverDetails.Samples = samples(500, 25)
+	}
+	return o
+}
+
+func (f *fakeManagement) nodes() []rabbithole.NodeInfo {
+	var xs []rabbithole.NodeInfo
+	for n := 0; n < f.Nodes; n++ {
+		node := rabbithole.NodeInfo{
+			Name:      fmt.Sprintf("rabbit@node-%d", n),
+			NodeType:  "disc",
+			IsRunning: n < f.Nodes-f.Stopped,
+			FdUsed:    100 + n,
+			FdTotal:   1024,
+			ProcUsed:  400 + n,
+			ProcTotal: 1048576,
+			MemUsed:   1 << 26,
+			MemLimit:  1 << 30,
+			DiskFree:  1 << 33,
+		}
+		node.Partitions = f.Partitions[node.Name]
+		node.IOReadCountDetails.Rate = 1.5
+		node.IOWriteCountDetails.Rate = 2.5
+		node.ConnectionCreatedDetails.Rate = 0.25
+		node.ConnectionClosedDetails.Rate = 0.25
+		xs = append(xs, node)
+	}
+	return xs
+}
+
+// pageOf returns the page the request asks for out of total items, and the
+// range of item indices on it.
+func (f *fakeManagement) pageOf(r *http.Request, total int) (info rabbithole.PageInfo, from int, to int) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if pageSize < 1 {
+		pageSize = f.PageSize
+	}
+	if pageSize < 1 {
+		pageSize = 100
+	}
+	from, to = (page-1)*pageSize, page*pageSize
+	if from > total {
+		from = total
+	}
+	if to > total {
+		to = total
+	}
+	info = rabbithole.PageInfo{
+		Page:          page,
+		PageSize:      pageSize,
+		PageCount:     (total + pageSize - 1) / pageSize,
+		FilteredCount: total,
+		ItemCount:     to - from,
+		TotalCount:    total,
+	}
+	return info, from, to
+}
+
+// queueStatsFields are the queue fields /api/queues leaves out with
+// disable_stats, and queueTotalsFields those it still returns when
+// enable_queue_totals is also set.
+var (
+	queueStatsFields  = []string{"consumers", "consumer_utilisation", "memory", "message_bytes", "message_bytes_persistent", "message_bytes_ram", "message_bytes_ready", "messages_details", "messages_persistent", "messages_ram", "messages_ready_details", "messages_unacknowledged_details", "message_stats", "head_message_timestamp", "idle_since", "backing_queue_status"}
+	queueTotalsFields = []string{"messages", "messages_ready", "messages_unacknowledged"}
+)
+
+func (f *fakeManagement) queuePage(r *http.Request) interface{} {
+	items := make([]interface{}, f.Queues)
+	for n := range items {
+		items[n] = f.queue(n)
+	}
+	return f.page(r, items)
+}
+
+// queueFields drops the fields of q that the request's disable_stats and
+// enable_queue_totals parameters leave out.
+func queueFields(r *http.Request, q interface{}) interface{} {
+	if r.URL.Query().Get("disable_stats") != "true" {
+		return q
+	}
+	doc := toDocument(q)
+	for _, field := range queueStatsFields {
+		delete(doc, field)
+	}
+	if r.URL.Query().Get("enable_queue_totals") != "true" {
+		for _, field := range queueTotalsFields {
+			delete(doc, field)
+		}
+	}
+	return doc
+}
+
+// selectColumns keeps only the fields of item named by the request's
+// columns parameter. Nested fields are named with dots, as in
+// message_stats.publish_in_details.rate.
+func selectColumns(r *http.Request, item interface{}) interface{} {
+	columns := r.URL.Query().Get("columns")
+	if columns == "" {
+		return item
+	}
+	doc := toDocument(item)
+	out := map[string]interface{}{}
+	for _, column := range strings.Split(columns, ",") {
+		copyColumn(out, doc, strings.Split(column, "."))
+	}
+	return out
+}
+
+func copyColumn(dst map[string]interface{}, src map[string]interface{}, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	d, _ := dst[path[0]].(map[string]interface{})
+	if d == nil {
+		d = map[string]interface{}{}
+		dst[path[0]] = d
+	}
+	copyColumn(d, sub, path[1:])
+}
+
+// toDocument returns v as the JSON object it is served as.
+func toDocument(v interface{}) map[string]interface{} {
+	if doc, ok := v.(map[string]interface{}); ok {
+		return doc
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// page serves a page of items in the shape every paged list endpoint
+// uses, with the fields the request asks for.
+func (f *fakeManagement) page(r *http.Request, items []interface{}) interface{} {
+	info, from, to := f.pageOf(r, len(items))
+	served := make([]interface{}, 0, to-from)
+	for _, item := range items[from:to] {
+		if _, ok := item.(rabbithole.QueueInfo); ok {
+			item = queueFields(r, item)
+		}
+		served = append(served, selectColumns(r, item))
+	}
+	return struct {
+		rabbithole.PageInfo
+		Items []interface{} `json:"items"`
+	}{info, served}
+}
+
+func (f *fakeManagement) exchanges() []rabbithole.ExchangeInfo {
+	xs := []rabbithole.ExchangeInfo{{Name: "", Vhost: "/", Type: "direct", Durable: true}}
+	for n := 1; n < f.Exchanges; n++ {
+		x := rabbithole.ExchangeInfo{Name: fmt.Sprintf("exchange-%d", n), Vhost: "/", Type: "topic", Durable: true}
+		x.MessageStats.PublishInDetails.Rate = float32(n)
+		x.MessageStats.PublishOutDetails.Rate = float32(n) / 2
+		if n%2 == 0 {
+			x.Arguments = map[string]interface{}{"alternate-exchange": "unrouted"}
+		}
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+// definitions exports the broker's definitions, or those of a single vhost
+// without users, permissions and the vhost field when vhost is set. Like
+// RabbitMQ it leaves out the default exchange.
+func (f *fakeManagement) definitions(vhost string) rabbithole.Definitions {
+	d := rabbithole.Definitions{RabbitVersion: "3.7.8", RabbitMQVersion: "3.7.8"}
+	if vhost == "" {
+		d.Users = f.Users
+		d.Vhosts = f.Vhosts
+		d.Permissions = f.Permissions
+	}
+	in := func(v string) bool { return vhost == "" || v == vhost }
+	for n := 0; n < f.Queues; n++ {
+		q := f.queue(n)
+		if in(q.Vhost) {
+			d.Queues = append(d.Queues, rabbithole.QueueDefinition{Name: q.Name, Vhost: q.Vhost, Durable: true, Arguments: q.Arguments})
+		}
+	}
+	for _, x := range f.exchanges() {
+		if x.Name != "" && in(x.Vhost) {
+			d.Exchanges = append(d.Exchanges, rabbithole.ExchangeDefinition{Name: x.Name, Vhost: x.Vhost, Type: x.Type, Durable: x.Durable, Arguments: x.Arguments})
+		}
+	}
+	for _, b := range f.Bindings {
+		if in(b.Vhost) {
+			d.Bindings = append(d.Bindings, b)
+		}
+	}
+	for _, p := range f.Policies {
+		if in(p.Vhost) {
+			d.Policies = append(d.Policies, p)
+		}
+	}
+	if vhost != "" {
+		for n := range d.Queues {
+			d.Queues[n].Vhost = ""
+		}
+		for n := range d.Exchanges {
+			d.Exchanges[n].Vhost = ""
+		}
+		for n := range d.Bindings {
+			d.Bindings[n].Vhost = ""
+		}
+		for n := range d.Policies {
+			d.Policies[n].Vhost = ""
+		}
+	}
+	return d
+}
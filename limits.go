@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+)
+
+// queueLimit is a numeric queue limit and whether it is set at all.
+type queueLimit struct {
+	Value int64
+	Set   bool
+}
+
+// queueLimits are the limits in effect for a queue.
+type queueLimits struct {
+	MaxLength      queueLimit
+	MaxLengthBytes queueLimit
+	// MessageTTL and Expires are in milliseconds.
+	MessageTTL queueLimit
+	Expires    queueLimit
+	// Overflow is what happens at a length limit: drop-head (the
+	// default), reject-publish or reject-publish-dlx.
+	Overflow string
+}
+
+func intArgument(args map[string]interface{}, key string) (int64, bool) {
+	switch v := args[key].(type) {
+	case float64:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// lowestLimit returns the smallest of the values set for key in the queue
+// arguments, as x-key, and in the policy and operator policy definitions.
+func lowestLimit(q rabbithole.QueueInfo, key string, definitions ...rabbithole.PolicyDefinition) queueLimit {
+	var limit queueLimit
+	limit.Value, limit.Set = intArgument(q.Arguments, "x-"+key)
+	for _, def := range definitions {
+		if v, ok := intArgument(def, key); ok && (!limit.Set || v < limit.Value) {
+			limit = queueLimit{Value: v, Set: true}
+		}
+	}
+	return limit
+}
+
+// resolveQueueLimits merges the queue's arguments with the definitions of
+// the policy and operator policy the broker applied to it. As in RabbitMQ
+// the lowest numeric limit wins, while the overflow behaviour, which
+// operator policies can't set, comes from the arguments before the policy.
+func resolveQueueLimits(q rabbithole.QueueInfo, r *routing) queueLimits {
+	def := r.policyDefinition(q.Vhost, q.Policy)
+	op := r.operatorPolicyDefinition(q.Vhost, q.OperatorPolicy)
+	limits := queueLimits{
+		MaxLength:      lowestLimit(q, "max-length", def, op),
+		MaxLengthBytes: lowestLimit(q, "max-length-bytes", def, op),
+		MessageTTL:     lowestLimit(q, "message-ttl", def, op),
+		Expires:        lowestLimit(q, "expires", def, op),
+		Overflow:       "drop-head",
+	}
+	if overflow, ok := stringArgument(q.Arguments, "x-overflow"); ok {
+		limits.Overflow = overflow
+	} else if overflow, ok := stringArgument(def, "overflow"); ok {
+		limits.Overflow = overflow
+	}
+	return limits
+}
+
+// usedPercent returns used as a percentage of limit, treating a zero
+// limit as full as soon as anything is used.
+func usedPercent(used int64, limit int64) float64 {
+	if limit <= 0 {
+		if used > 0 {
+			return 100
+		}
+		return 0
+	}
+	return float64(used) * 100 / float64(limit)
+}
+
+// populateQueueLimits reports the limits that are set and how much of the
+// length limits the queue uses. RabbitMQ only counts ready messages
+// against them, not those delivered and waiting for an ack. At 100% a
+// reject-publish queue refuses new messages and a drop-head queue starts
+// discarding its oldest. Byte usage is only reported withBytes, as low
+// overhead mode doesn't read message_bytes_ready.
+func populateQueueLimits(ms *metric.Set, q rabbithole.QueueInfo, limits queueLimits, withBytes bool) {
+	if limits.MaxLength.Set {
+		ms.SetMetric("max_length", limits.MaxLength.Value, metric.GAUGE)
+		ms.SetMetric("max_length_used_percent", usedPercent(int64(q.MessagesReady), limits.MaxLength.Value), metric.GAUGE)
+	}
+	if limits.MaxLengthBytes.Set {
+		ms.SetMetric("max_length_bytes", limits.MaxLengthBytes.Value, metric.GAUGE)
+	}
+	if limits.MaxLengthBytes.Set && withBytes {
+		ms.SetMetric("max_length_bytes_used_percent", usedPercent(q.MessagesBytesReady, limits.MaxLengthBytes.Value), metric.GAUGE)
+	}
+	if limits.MaxLength.Set || limits.MaxLengthBytes.Set {
+		ms.SetMetric("overflow", limits.Overflow, metric.ATTRIBUTE)
+	}
+	if limits.MessageTTL.Set {
+		ms.SetMetric("message_ttl", limits.MessageTTL.Value, metric.GAUGE)
+	}
+	if limits.Expires.Set {
+		ms.SetMetric("expires", limits.Expires.Value, metric.GAUGE)
+	}
+}
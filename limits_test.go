@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+func TestResolveQueueLimits(t *testing.T) {
+	routes := newRouting(nil, nil, []rabbithole.Policy{
+		{Vhost: "/", Name: "limits", Definition: rabbithole.PolicyDefinition{"max-length": float64(100), "max-length-bytes": float64(1 << 20), "overflow": "reject-publish"}},
+	})
+	routes.OperatorPolicies[[2]string{"/", "caps"}] = rabbithole.Policy{Vhost: "/", Name: "caps", Definition: rabbithole.PolicyDefinition{"max-length": float64(50), "message-ttl": float64(1000)}}
+
+	cases := []struct {
+		name  string
+		queue rabbithole.QueueInfo
+		want  queueLimits
+	}{
+		{
+			name:  "no limits",
+			queue: rabbithole.QueueInfo{Name: "q", Vhost: "/"},
+			want:  queueLimits{Overflow: "drop-head"},
+		},
+		{
+			name:  "lower argument wins over the policy",
+			queue: rabbithole.QueueInfo{Name: "q", Vhost: "/", Policy: "limits", Arguments: map[string]interface{}{"x-max-length": float64(10)}},
+			want:  queueLimits{MaxLength: queueLimit{10, true}, MaxLengthBytes: queueLimit{1 << 20, true}, Overflow: "reject-publish"},
+		},
+		{
+			name:  "lower policy wins over the argument",
+			queue: rabbithole.QueueInfo{Name: "q", Vhost: "/", Policy: "limits", Arguments: map[string]interface{}{"x-max-length": float64(500), "x-overflow": "drop-head"}},
+			want:  queueLimits{MaxLength: queueLimit{100, true}, MaxLengthBytes: queueLimit{1 << 20, true}, Overflow: "drop-head"},
+		},
+		{
+			name:  "operator policy caps the policy",
+			queue: rabbithole.QueueInfo{Name: "q", Vhost: "/", Policy: "limits", OperatorPolicy: "caps"},
+			want:  queueLimits{MaxLength: queueLimit{50, true}, MaxLengthBytes: queueLimit{1 << 20, true}, MessageTTL: queueLimit{1000, true}, Overflow: "reject-publish"},
+		},
+	}
+	for _, c := range cases {
+		if got := resolveQueueLimits(c.queue, routes); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUsedPercent(t *testing.T) {
+	for _, c := range []struct {
+		used, limit int64
+		want        float64
+	}{{5, 10, 50}, {10, 10, 100}, {0, 0, 0}, {1, 0, 100}} {
+		if got := usedPercent(c.used, c.limit); got != c.want {
+			t.Errorf("%d of %d: got %v", c.used, c.limit, got)
+		}
+	}
+}
+
+func TestQueueLimitsCountReadyMessages(t *testing.T) {
+	i, err := integration.New(integrationName, integrationVersion, integration.InMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := i.Entity("q", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := e.NewMetricSet("Rabbitmq_Queues")
+	// Half the messages are delivered and waiting for an ack, which the
+	// length limits don't count.
+	q := rabbithole.QueueInfo{Messages: 10, MessagesReady: 5, MessagesUnacknowledged: 5, MessagesBytes: 8192, MessagesBytesReady: 4096}
+	populateQueueLimits(ms, q, queueLimits{MaxLength: queueLimit{10, true}, MaxLengthBytes: queueLimit{8192, true}, Overflow: "reject-publish"}, true)
+	for name, want := range map[string]float64{"max_length_used_percent": 50, "max_length_bytes_used_percent": 50} {
+		if got := ms.Metrics[name]; got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+const (
+	// Bounds of the page_size adaptive paging picks. maxPageSize is also
+	// the largest page_size the management API accepts.
+	minPageSize = 100
+	maxPageSize = 500
+	// Adaptive paging aims for roughly this many pages per run and hands
+	// each worker this many pages before another worker is added.
+	adaptiveTargetPages    = 20
+	adaptivePagesPerWorker = 5
+	// Upper bound on workers in adaptive mode when QUEUE_FETCH_WORKER_COUNT is unset.
+	adaptiveMaxWorkers = 8
+)
+
+// queueColumns lists the queue fields the collectors read. Anything else
+// the management API would compute for a queue is wasted work. In low
+// overhead mode only the fields the queues track themselves are asked for,
+// as the broker leaves out everything that comes from the stats DB.
+func queueColumns(cfg Config) []string {
+	columns := []string{"name", "vhost", "type", "arguments", "policy", "operator_policy", "messages", "messages_ready", "messages_unacknowledged"}
+	if !cfg.LowOverhead {
+		columns = append(columns, "consumers", "message_bytes", "message_bytes_ready", "head_message_timestamp", "idle_since", "messages_details", "messages_ready_details", "messages_unacknowledged_details", "message_stats")
+	}
+	return columns
+}
+
+// queueParameters returns the query used for every /api/queues page.
+// In low overhead mode the stats DB is bypassed entirely and only the
+// message totals tracked by the queues themselves are returned: there are
+// no consumer counts, message bytes, head message timestamps or idle times.
+func queueParameters(cfg Config) url.Values {
+	values := url.Values{}
+	if cfg.LowOverhead {
+		values.Set("disable_stats", "true")
+		values.Set("enable_queue_totals", "true")
+	} else {
+		values = sampleParameters(cfg)
+	}
+	values.Set("columns", strings.Join(queueColumns(cfg), ","))
+	return values
+}
+
+// exchangeParameters returns the query used for /api/exchanges. Exchange
+// metrics are all stats DB rates, so disable_stats is never set here.
+func exchangeParameters() url.Values {
+	values := url.Values{}
+	values.Set("columns", "name,vhost,type,arguments,policy,message_stats.publish_in_details.rate,message_stats.publish_out_details.rate")
+	return values
+}
+
+// pagedQueueParameters returns queueParameters for a single page.
+func pagedQueueParameters(cfg Config, page int, pageSize int) url.Values {
+	values := queueParameters(cfg)
+	values.Set("page", strconv.Itoa(page))
+	if pageSize > 0 {
+		values.Set("page_size", strconv.Itoa(pageSize))
+	}
+	return values
+}
+
+// adaptivePaging picks a page size and worker count from the totals in the
+// first page of results, so small clusters are fetched in a handful of
+// requests and large ones never put more than maxWorkers requests in flight.
+func adaptivePaging(first rabbithole.PagedQueueInfo, maxWorkers int) (pageSize int, pageCount int, workers int) {
+	if maxWorkers <= 0 {
+		maxWorkers = adaptiveMaxWorkers
+	}
+	pageSize = first.TotalCount / adaptiveTargetPages
+	if pageSize < minPageSize {
+		pageSize = minPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	pageCount = (first.TotalCount + pageSize - 1) / pageSize
+	workers = (pageCount + adaptivePagesPerWorker - 1) / adaptivePagesPerWorker
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > maxWorkers {
+		workers = maxWorkers
+	}
+	return pageSize, pageCount, workers
+}
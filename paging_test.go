@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+func TestAdaptivePaging(t *testing.T) {
+	cases := []struct {
+		total, maxWorkers            int
+		pageSize, pageCount, workers int
+	}{
+		{total: 0, pageSize: 100, pageCount: 0, workers: 1},
+		{total: 250, pageSize: 100, pageCount: 3, workers: 1},
+		{total: 5000, pageSize: 250, pageCount: 20, workers: 4},
+		{total: 100000, pageSize: 500, pageCount: 200, workers: 8},
+		{total: 100000, maxWorkers: 2, pageSize: 500, pageCount: 200, workers: 2},
+	}
+	for _, c := range cases {
+		pageSize, pageCount, workers := adaptivePaging(rabbithole.PagedQueueInfo{TotalCount: c.total}, c.maxWorkers)
+		if pageSize != c.pageSize || pageCount != c.pageCount || workers != c.workers {
+			t.Errorf("total %d, max workers %d: got %d/%d/%d, want %d/%d/%d", c.total, c.maxWorkers,
+				pageSize, pageCount, workers, c.pageSize, c.pageCount, c.workers)
+		}
+	}
+}
+
+func TestQueueParametersLowOverhead(t *testing.T) {
+	values := queueParameters(Config{LowOverhead: true, LengthsAge: 60})
+	if values.Get("disable_stats") != "true" || values.Get("enable_queue_totals") != "true" {
+		t.Errorf("expected the stats DB to be bypassed, got %s", values.Encode())
+	}
+	if values.Get("lengths_age") != "" {
+		t.Errorf("sample parameters should not be sent in low overhead mode, got %s", values.Encode())
+	}
+}
+
+func TestQueueCountSkipsStats(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1, Queues: 3}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	if _, err := runCollect(t, newTestClient(t, srv.URL), Config{Workers: 1}, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range fake.Requests() {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Get("columns") == "name" {
+			if u.Query().Get("disable_stats") != "true" {
+				t.Errorf("expected the queue count to be read without stats, got %s", uri)
+			}
+			return
+		}
+	}
+	t.Error("the queue count was not requested")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/event"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// partitionView is the cluster-wide picture of network partitions built
+// from the partitions list every node reports.
+type partitionView struct {
+	// Map holds, for each node reporting a partition, the peers it can no
+	// longer reach.
+	Map map[string][]string
+	// Partitioned is set when any node reports a partition.
+	Partitioned bool
+	// Disagreements lists the pairs of running nodes whose views differ:
+	// one lists the other as partitioned but not the reverse.
+	Disagreements []string
+}
+
+// buildPartitionView combines the per-node partition lists. Partitions are
+// normally symmetric, so a one-sided entry between two running nodes means
+// the nodes' views disagree, e.g. while a partition is forming or healing.
+func buildPartitionView(nodes []rabbithole.NodeInfo) partitionView {
+	view := partitionView{Map: map[string][]string{}}
+	running := map[string]bool{}
+	sees := map[string]map[string]bool{}
+	for _, node := range nodes {
+		running[node.Name] = node.IsRunning
+		if len(node.Partitions) == 0 {
+			continue
+		}
+		peers := append([]string(nil), node.Partitions...)
+		sort.Strings(peers)
+		view.Map[node.Name] = peers
+		sees[node.Name] = map[string]bool{}
+		for _, peer := range peers {
+			sees[node.Name][peer] = true
+		}
+	}
+	view.Partitioned = len(view.Map) > 0
+
+	var names []string
+	for name := range view.Map {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, peer := range view.Map[name] {
+			if running[name] && running[peer] && !sees[peer][name] {
+				view.Disagreements = append(view.Disagreements, fmt.Sprintf("%s sees %s as partitioned but not the reverse", name, peer))
+			}
+		}
+	}
+	return view
+}
+
+// populatePartitions reports the partition view on the cluster entity. An
+// event carrying the partition map is sent on the run where it changes,
+// and one when the partition clears.
+func populatePartitions(e *integration.Entity, ms *metric.Set, nodes []rabbithole.NodeInfo, cfg Config) error {
+	view := buildPartitionView(nodes)
+	partitioned, disagree := 0, 0
+	if view.Partitioned {
+		partitioned = 1
+	}
+	if len(view.Disagreements) > 0 {
+		disagree = 1
+	}
+	ms.SetMetric("Partitioned", partitioned, metric.GAUGE)
+	ms.SetMetric("Partitioned Nodes", len(view.Map), metric.GAUGE)
+	ms.SetMetric("Partition Views Disagree", disagree, metric.GAUGE)
+
+	var partitionMap []byte
+	if view.Partitioned {
+		var err error
+		if partitionMap, err = json.Marshal(view.Map); err != nil {
+			return err
+		}
+	}
+	key := "partitions:" + overviewEntityName(cfg)
+	var previous string
+	cfg.State.Get(key, &previous)
+	cfg.State.Set(key, string(partitionMap))
+	if string(partitionMap) == previous {
+		return nil
+	}
+	if !view.Partitioned {
+		return e.AddEvent(event.New("Network partition cleared", "RabbitMQ"))
+	}
+	summary := fmt.Sprintf("Network partition detected: %s", partitionMap)
+	if disagree == 1 {
+		summary += ". Node views disagree: " + strings.Join(view.Disagreements, "; ")
+	}
+	return e.AddEvent(event.New(summary, "RabbitMQ"))
+}
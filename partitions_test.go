@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestBuildPartitionView(t *testing.T) {
+	cases := []struct {
+		name          string
+		nodes         []rabbithole.NodeInfo
+		partitioned   bool
+		partitionMap  map[string][]string
+		disagreements []string
+	}{
+		{
+			name:         "healthy",
+			nodes:        []rabbithole.NodeInfo{{Name: "a", IsRunning: true}, {Name: "b", IsRunning: true}},
+			partitionMap: map[string][]string{},
+		},
+		{
+			name: "split brain",
+			nodes: []rabbithole.NodeInfo{
+				{Name: "a", IsRunning: true, Partitions: []string{"c"}},
+				{Name: "b", IsRunning: true, Partitions: []string{"c"}},
+				{Name: "c", IsRunning: true, Partitions: []string{"b", "a"}},
+			},
+			partitioned:  true,
+			partitionMap: map[string][]string{"a": {"c"}, "b": {"c"}, "c": {"a", "b"}},
+		},
+		{
+			name: "views disagree",
+			nodes: []rabbithole.NodeInfo{
+				{Name: "a", IsRunning: true, Partitions: []string{"b"}},
+				{Name: "b", IsRunning: true},
+				{Name: "c", IsRunning: false},
+			},
+			partitioned:   true,
+			partitionMap:  map[string][]string{"a": {"b"}},
+			disagreements: []string{"a sees b as partitioned but not the reverse"},
+		},
+		{
+			name: "stopped peer can't disagree",
+			nodes: []rabbithole.NodeInfo{
+				{Name: "a", IsRunning: true, Partitions: []string{"b"}},
+				{Name: "b", IsRunning: false},
+			},
+			partitioned:  true,
+			partitionMap: map[string][]string{"a": {"b"}},
+		},
+	}
+	for _, c := range cases {
+		view := buildPartitionView(c.nodes)
+		if view.Partitioned != c.partitioned || !reflect.DeepEqual(view.Map, c.partitionMap) || !reflect.DeepEqual(view.Disagreements, c.disagreements) {
+			t.Errorf("%s: got %+v", c.name, view)
+		}
+	}
+}
+
+func TestPartitionEventOnChange(t *testing.T) {
+	fake := &fakeManagement{Nodes: 3}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	cfg := Config{Cluster: "c", Workers: 1, State: persist.NewInMemoryStore()}
+
+	split := map[string][]string{"rabbit@node-0": {"rabbit@node-2"}, "rabbit@node-2": {"rabbit@node-0"}}
+	wider := map[string][]string{"rabbit@node-0": {"rabbit@node-1", "rabbit@node-2"}, "rabbit@node-1": {"rabbit@node-0"}, "rabbit@node-2": {"rabbit@node-0"}}
+	// healthy, partitioned twice with the same map, the map changes, then it clears
+	for n, c := range []struct {
+		partitions map[string][]string
+		event      string
+	}{{nil, ""}, {split, "Network partition detected"}, {split, ""}, {wider, "Network partition detected"}, {nil, "Network partition cleared"}, {nil, ""}} {
+		fake.Partitions = c.partitions
+		payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := overviewEvents(t, payload)
+		if c.event == "" && len(events) != 0 || c.event != "" && (len(events) != 1 || !strings.HasPrefix(events[0], c.event)) {
+			t.Errorf("run %d: unexpected events %q", n, events)
+		}
+	}
+}
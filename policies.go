@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jordanbcooper/newrelic-integration-rabbitmq/policy"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/log"
+)
+
+// populatePolicyCheck reports the policy a queue or exchange has next to
+// the one that should apply to it.
+func populatePolicyCheck(ms *metric.Set, actual string, expected policy.Result) {
+	if actual != "" {
+		ms.SetMetric("policy", actual, metric.ATTRIBUTE)
+	}
+	if expected.Policy != "" {
+		ms.SetMetric("expected_policy", expected.Policy, metric.ATTRIBUTE)
+	}
+	mismatch, ambiguous := 0, 0
+	if !expected.Matches(actual) {
+		mismatch = 1
+	}
+	if len(expected.Tied) > 0 {
+		ambiguous = 1
+	}
+	ms.SetMetric("policy_mismatch", mismatch, metric.GAUGE)
+	ms.SetMetric("policy_ambiguous", ambiguous, metric.GAUGE)
+}
+
+// populatePolicyReport reports the cluster-wide outcome of the policy
+// checks on the overview and logs the details. Unused policies need every
+// queue and exchange to have been checked, so they are left out when
+// complete is false.
+func populatePolicyReport(ms *metric.Set, report *policy.Report, complete bool) {
+	mismatches := report.Mismatches()
+	ambiguous := report.Ambiguous()
+	ms.SetMetric("Policy Mismatches", len(mismatches), metric.GAUGE)
+	ms.SetMetric("Ambiguous Policy Objects", len(ambiguous), metric.GAUGE)
+	for _, m := range mismatches {
+		log.Warn("Policy mismatch: %s", m)
+	}
+	for _, m := range ambiguous {
+		log.Warn("Several policies match %s %s in vhost %s at the same priority: %s", m.Object.Kind, m.Object.Name, m.Object.Vhost, strings.Join(m.Expected.Tied, ", "))
+	}
+
+	invalid := report.Invalid()
+	ms.SetMetric("Invalid Policies", len(invalid), metric.GAUGE)
+	for _, p := range invalid {
+		log.Warn("Policy %s in vhost %s has a pattern that can't be checked: %v", p.Policy.Name, p.Policy.Vhost, p.Err)
+	}
+
+	if !complete {
+		return
+	}
+	var names []string
+	for _, p := range report.Unused() {
+		names = append(names, entityKey(p.Vhost, p.Name))
+	}
+	ms.SetMetric("Unused Policies", len(names), metric.GAUGE)
+	if len(names) > 0 {
+		ms.SetMetric("Unused Policy Names", strings.Join(names, ","), metric.ATTRIBUTE)
+	}
+}
@@ -0,0 +1,275 @@
+// Package policy implements RabbitMQ's policy matching: which policy, if
+// any, applies to a queue or exchange. A policy matches an object in its
+// vhost whose name its pattern matches, when its apply-to covers the
+// object, and of the policies that match the one with the highest
+// priority applies.
+//
+// A Report checks objects against what the broker says applies to them,
+// to find policies that never took effect because of a typo in a pattern
+// or an unexpected priority.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+// Object is a queue or exchange as the broker reports it.
+type Object struct {
+	Vhost string
+	Name  string
+	// Kind is "queue" or "exchange".
+	Kind string
+	// QueueType is "classic", "quorum" or "stream", or empty when unknown.
+	QueueType string
+	// Policy is the policy the broker says applies, empty for none.
+	Policy string
+}
+
+// Result is the policy that should apply to an object.
+type Result struct {
+	// Policy is the name of the matching policy with the highest
+	// priority, empty when none matches.
+	Policy string
+	// Tied lists, in name order, every policy matching at the highest
+	// priority when there are several. Which of them RabbitMQ applies is
+	// then undefined.
+	Tied []string
+}
+
+// Matches reports whether actual is the policy the result expects, or
+// one of the tied policies.
+func (r Result) Matches(actual string) bool {
+	if len(r.Tied) == 0 {
+		return actual == r.Policy
+	}
+	for _, name := range r.Tied {
+		if actual == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidPolicy is a policy whose pattern can't be compiled. RabbitMQ uses
+// PCRE, so a pattern it accepts may still use syntax Go lacks, such as
+// lookaheads.
+type InvalidPolicy struct {
+	Policy rabbithole.Policy
+	Err    error
+}
+
+type compiled struct {
+	policy  rabbithole.Policy
+	pattern *regexp.Regexp
+}
+
+// Resolver matches objects against a set of policies. It is safe for
+// concurrent use.
+type Resolver struct {
+	// by vhost, highest priority first
+	policies map[string][]compiled
+	invalid  []InvalidPolicy
+}
+
+// New compiles the policies. Policies with a pattern that doesn't compile
+// are left out and listed by Invalid.
+func New(policies []rabbithole.Policy) *Resolver {
+	r := &Resolver{policies: map[string][]compiled{}}
+	for _, p := range policies {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			r.invalid = append(r.invalid, InvalidPolicy{Policy: p, Err: err})
+			continue
+		}
+		r.policies[p.Vhost] = append(r.policies[p.Vhost], compiled{policy: p, pattern: re})
+	}
+	for _, ps := range r.policies {
+		sort.SliceStable(ps, func(a, b int) bool {
+			if ps[a].policy.Priority != ps[b].policy.Priority {
+				return ps[a].policy.Priority > ps[b].policy.Priority
+			}
+			return ps[a].policy.Name < ps[b].policy.Name
+		})
+	}
+	return r
+}
+
+// Invalid returns the policies left out because their pattern doesn't
+// compile.
+func (r *Resolver) Invalid() []InvalidPolicy {
+	return r.invalid
+}
+
+// appliesTo reports whether a policy's apply-to covers the object.
+// Queue-type specific values (RabbitMQ 3.12+) match queues of unknown type.
+func appliesTo(applyTo string, o Object) bool {
+	switch applyTo {
+	case "", "all":
+		return o.Kind == "queue" || o.Kind == "exchange"
+	case "queues":
+		return o.Kind == "queue"
+	case "exchanges":
+		return o.Kind == "exchange"
+	case "classic_queues":
+		return o.Kind == "queue" && (o.QueueType == "" || o.QueueType == "classic")
+	case "quorum_queues":
+		return o.Kind == "queue" && (o.QueueType == "" || o.QueueType == "quorum")
+	case "streams":
+		return o.Kind == "queue" && (o.QueueType == "" || o.QueueType == "stream")
+	}
+	return false
+}
+
+// matching returns the policies that match o, highest priority first.
+func (r *Resolver) matching(o Object) []rabbithole.Policy {
+	var matched []rabbithole.Policy
+	for _, c := range r.policies[o.Vhost] {
+		if appliesTo(c.policy.ApplyTo, o) && c.pattern.MatchString(o.Name) {
+			matched = append(matched, c.policy)
+		}
+	}
+	return matched
+}
+
+// Resolve returns the policy that should apply to o.
+func (r *Resolver) Resolve(o Object) Result {
+	return resultOf(r.matching(o))
+}
+
+func resultOf(matched []rabbithole.Policy) Result {
+	if len(matched) == 0 {
+		return Result{}
+	}
+	result := Result{Policy: matched[0].Name}
+	for _, p := range matched[1:] {
+		if p.Priority != matched[0].Priority {
+			break
+		}
+		if result.Tied == nil {
+			result.Tied = []string{matched[0].Name}
+		}
+		result.Tied = append(result.Tied, p.Name)
+	}
+	return result
+}
+
+// Mismatch is an object whose policy isn't the one that should apply.
+type Mismatch struct {
+	Object   Object
+	Expected Result
+}
+
+func (m Mismatch) String() string {
+	expected := m.Expected.Policy
+	if len(m.Expected.Tied) > 0 {
+		expected = fmt.Sprintf("one of %v", m.Expected.Tied)
+	}
+	if expected == "" {
+		expected = "none"
+	}
+	actual := m.Object.Policy
+	if actual == "" {
+		actual = "none"
+	}
+	return fmt.Sprintf("%s %s in vhost %s has policy %s, expected %s", m.Object.Kind, m.Object.Name, m.Object.Vhost, actual, expected)
+}
+
+// Report collects the results of checking objects against a Resolver:
+// mismatched objects, objects matched by several policies at the same
+// priority and, once every object is checked, the policies that matched
+// nothing. It is safe for concurrent use.
+type Report struct {
+	resolver *Resolver
+
+	mu         sync.Mutex
+	used       map[[2]string]bool
+	mismatches []Mismatch
+	ambiguous  []Mismatch
+}
+
+// NewReport starts a report over the resolver's policies.
+func NewReport(r *Resolver) *Report {
+	return &Report{resolver: r, used: map[[2]string]bool{}}
+}
+
+// Check resolves o, records the outcome and returns it.
+func (rep *Report) Check(o Object) Result {
+	matched := rep.resolver.matching(o)
+	result := resultOf(matched)
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	for _, p := range matched {
+		rep.used[[2]string{p.Vhost, p.Name}] = true
+	}
+	if !result.Matches(o.Policy) {
+		rep.mismatches = append(rep.mismatches, Mismatch{Object: o, Expected: result})
+	}
+	if len(result.Tied) > 0 {
+		rep.ambiguous = append(rep.ambiguous, Mismatch{Object: o, Expected: result})
+	}
+	return result
+}
+
+func sortMismatches(ms []Mismatch) []Mismatch {
+	sorted := append([]Mismatch(nil), ms...)
+	sort.Slice(sorted, func(a, b int) bool {
+		x, y := sorted[a].Object, sorted[b].Object
+		if x.Vhost != y.Vhost {
+			return x.Vhost < y.Vhost
+		}
+		if x.Kind != y.Kind {
+			return x.Kind < y.Kind
+		}
+		return x.Name < y.Name
+	})
+	return sorted
+}
+
+// Mismatches returns the checked objects whose policy isn't the expected
+// one, ordered by vhost, kind and name.
+func (rep *Report) Mismatches() []Mismatch {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return sortMismatches(rep.mismatches)
+}
+
+// Ambiguous returns the checked objects matched by several policies at the
+// highest priority, ordered by vhost, kind and name.
+func (rep *Report) Ambiguous() []Mismatch {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return sortMismatches(rep.ambiguous)
+}
+
+// Invalid returns the policies the resolver left out.
+func (rep *Report) Invalid() []InvalidPolicy {
+	return rep.resolver.Invalid()
+}
+
+// Unused returns the valid policies that matched none of the checked
+// objects, ordered by vhost and name. It is only meaningful once every
+// queue and exchange has been checked.
+func (rep *Report) Unused() []rabbithole.Policy {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	var unused []rabbithole.Policy
+	for _, ps := range rep.resolver.policies {
+		for _, c := range ps {
+			if !rep.used[[2]string{c.policy.Vhost, c.policy.Name}] {
+				unused = append(unused, c.policy)
+			}
+		}
+	}
+	sort.Slice(unused, func(a, b int) bool {
+		if unused[a].Vhost != unused[b].Vhost {
+			return unused[a].Vhost < unused[b].Vhost
+		}
+		return unused[a].Name < unused[b].Name
+	})
+	return unused
+}
@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+var testPolicies = []rabbithole.Policy{
+	{Vhost: "/", Name: "ha-all", Pattern: ".*", ApplyTo: "all", Priority: 0},
+	{Vhost: "/", Name: "ha-orders", Pattern: "^orders\\.", ApplyTo: "queues", Priority: 10},
+	{Vhost: "/", Name: "orders-ttl", Pattern: "^orders\\.eu", ApplyTo: "queues", Priority: 10},
+	{Vhost: "/", Name: "ae", Pattern: "^orders$", ApplyTo: "exchanges", Priority: 10},
+	{Vhost: "/", Name: "quorum-only", Pattern: "^payments", ApplyTo: "quorum_queues", Priority: 20},
+	{Vhost: "/", Name: "typo", Pattern: "^ordres\\.", ApplyTo: "queues", Priority: 30},
+	{Vhost: "/", Name: "lookahead", Pattern: "^(?!amq\\.)", ApplyTo: "queues", Priority: 5},
+	{Vhost: "other", Name: "other-all", Pattern: ".*", ApplyTo: "all"},
+}
+
+func TestResolve(t *testing.T) {
+	r := New(testPolicies)
+	cases := []struct {
+		object Object
+		want   Result
+	}{
+		{Object{Vhost: "/", Name: "orders.us", Kind: "queue"}, Result{Policy: "ha-orders"}},
+		{Object{Vhost: "/", Name: "orders.eu", Kind: "queue"}, Result{Policy: "ha-orders", Tied: []string{"ha-orders", "orders-ttl"}}},
+		{Object{Vhost: "/", Name: "orders", Kind: "exchange"}, Result{Policy: "ae"}},
+		{Object{Vhost: "/", Name: "orders.us", Kind: "exchange"}, Result{Policy: "ha-all"}},
+		{Object{Vhost: "/", Name: "payments", Kind: "queue", QueueType: "quorum"}, Result{Policy: "quorum-only"}},
+		{Object{Vhost: "/", Name: "payments", Kind: "queue", QueueType: "classic"}, Result{Policy: "ha-all"}},
+		{Object{Vhost: "other", Name: "orders.us", Kind: "queue"}, Result{Policy: "other-all"}},
+		{Object{Vhost: "empty", Name: "orders.us", Kind: "queue"}, Result{}},
+	}
+	for _, c := range cases {
+		if got := r.Resolve(c.object); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: got %+v, want %+v", c.object, got, c.want)
+		}
+	}
+
+	if invalid := r.Invalid(); len(invalid) != 1 || invalid[0].Policy.Name != "lookahead" {
+		t.Errorf("expected the lookahead pattern to be invalid, got %+v", invalid)
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := NewReport(New(testPolicies))
+	for _, o := range []Object{
+		{Vhost: "/", Name: "orders.us", Kind: "queue", Policy: "ha-orders"},
+		{Vhost: "/", Name: "orders.eu", Kind: "queue", Policy: "orders-ttl"},
+		{Vhost: "/", Name: "orders", Kind: "exchange", Policy: "ha-all"},
+		{Vhost: "/", Name: "payments", Kind: "queue", QueueType: "quorum", Policy: "quorum-only"},
+		{Vhost: "other", Name: "unpoliced", Kind: "queue"},
+	} {
+		report.Check(o)
+	}
+
+	var mismatches []string
+	for _, m := range report.Mismatches() {
+		mismatches = append(mismatches, m.String())
+	}
+	want := []string{
+		"exchange orders in vhost / has policy ha-all, expected ae",
+		"queue unpoliced in vhost other has policy none, expected other-all",
+	}
+	if !reflect.DeepEqual(mismatches, want) {
+		t.Errorf("got mismatches %q", mismatches)
+	}
+
+	if ambiguous := report.Ambiguous(); len(ambiguous) != 1 || ambiguous[0].Object.Name != "orders.eu" {
+		t.Errorf("expected orders.eu to be ambiguous, got %+v", ambiguous)
+	}
+
+	var unused []string
+	for _, p := range report.Unused() {
+		unused = append(unused, p.Name)
+	}
+	if !reflect.DeepEqual(unused, []string{"typo"}) {
+		t.Errorf("got unused policies %v", unused)
+	}
+}
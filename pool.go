@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+// defaultWorkers is used when QUEUE_FETCH_WORKER_COUNT is unset or not positive.
+const defaultWorkers = 4
+
+// retryPolicy retries a failed page with exponential backoff: Backoff
+// after the first failure, twice that after the second and so on.
+type retryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// do calls fn until it succeeds, the attempts are used up or ctx is done.
+func (p retryPolicy) do(ctx context.Context, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for n := 0; n < attempts; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(p.Backoff << uint(n-1)):
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			return err
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// pageError is the final error for a single page once its retries are used up.
+type pageError struct {
+	Page int
+	Err  error
+}
+
+// pageErrors collects the pages that could not be fetched. The pages that
+// were fetched have already been reported, so it describes a partial result.
+type pageErrors struct {
+	Object string
+	Pages  int
+	Errors []pageError
+}
+
+// maxReportedPageErrors bounds how many page errors are spelled out in Error.
+const maxReportedPageErrors = 5
+
+func (e *pageErrors) Error() string {
+	msgs := make([]string, 0, maxReportedPageErrors+1)
+	for n, pe := range e.Errors {
+		if n == maxReportedPageErrors {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Errors)-n))
+			break
+		}
+		msgs = append(msgs, fmt.Sprintf("page %d: %v", pe.Page, pe.Err))
+	}
+	return fmt.Sprintf("%d of %d %s pages failed: %s", len(e.Errors), e.Pages, e.Object, strings.Join(msgs, "; "))
+}
+
+// fetchPages calls fetch for pages first to last from a pool of workers,
+// retrying each page according to policy. fetch only reads a page and
+// returns populate, which reports it; populate is called once, after the
+// page was read, so a retried page is never reported twice. Once ctx is
+// done the remaining pages fail with its error instead of being requested.
+// It returns a *pageErrors listing every page that failed, or nil.
+func fetchPages(ctx context.Context, object string, first int, last int, workers int, policy retryPolicy, fetch func(page int) (populate func() error, err error)) error {
+	pageCount := last - first + 1
+	if pageCount < 1 {
+		return nil
+	}
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	if workers > pageCount {
+		workers = pageCount
+	}
+
+	jobs := make(chan int)
+	failed := make(chan pageError, pageCount)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range jobs {
+				page := page
+				var populate func() error
+				err := policy.do(ctx, func() error {
+					var err error
+					populate, err = fetch(page)
+					return err
+				})
+				if err == nil && populate != nil {
+					err = populate()
+				}
+				if err != nil {
+					failed <- pageError{Page: page, Err: err}
+				}
+			}
+		}()
+	}
+	for page := first; page <= last; page++ {
+		jobs <- page
+	}
+	close(jobs)
+	wg.Wait()
+	close(failed)
+
+	var errs []pageError
+	for pe := range failed {
+		errs = append(errs, pe)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(a, b int) bool { return errs[a].Page < errs[b].Page })
+	return &pageErrors{Object: object, Pages: pageCount, Errors: errs}
+}
+
+// fetchAllPages walks every page of a list endpoint such as "exchanges" or
+// "connections". The first page is fetched on its own to learn the page
+// count and the rest are spread over a pool of workers by fetchPages.
+// handle is called once for each page that was read, possibly
+// concurrently. Pages are only retried by policy, not also by the client.
+func fetchAllPages(ctx context.Context, rmqc managementClient, object string, path string, params url.Values, pageSize int, workers int, policy retryPolicy, handle func(rabbithole.Page) error) error {
+	rmqc = rmqc.WithoutRetries()
+	fetch := func(page int) (rabbithole.Page, error) {
+		return rmqc.ListPage(path, rabbithole.PageParameters{Page: page, PageSize: pageSize}.Values(params))
+	}
+
+	var first rabbithole.Page
+	err := policy.do(ctx, func() error {
+		var err error
+		first, err = fetch(1)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := handle(first); err != nil {
+		return err
+	}
+	return fetchPages(ctx, object, 2, first.PageCount, workers, policy, func(page int) (func() error, error) {
+		p, err := fetch(page)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return handle(p) }, nil
+	})
+}
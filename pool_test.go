@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+func TestFetchPagesRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[int]int{}
+	populated := map[int]int{}
+	err := fetchPages(context.Background(), "queue", 1, 5, 2, retryPolicy{Attempts: 3, Backoff: time.Millisecond}, func(page int) (func() error, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[page]++
+		if page == 2 && calls[page] < 3 {
+			return nil, errors.New("unavailable")
+		}
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			populated[page]++
+			return nil
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for page := 1; page <= 5; page++ {
+		want := 1
+		if page == 2 {
+			want = 3
+		}
+		if calls[page] != want {
+			t.Errorf("page %d: expected %d calls, got %d", page, want, calls[page])
+		}
+		if populated[page] != 1 {
+			t.Errorf("page %d: expected to be populated once, got %d", page, populated[page])
+		}
+	}
+}
+
+func TestFetchPagesAggregatesErrors(t *testing.T) {
+	err := fetchPages(context.Background(), "queue", 1, 8, 0, retryPolicy{Attempts: 2}, func(page int) (func() error, error) {
+		if page%3 == 0 {
+			return nil, errors.New("unavailable")
+		}
+		return nil, nil
+	})
+	perr, ok := err.(*pageErrors)
+	if !ok {
+		t.Fatalf("expected *pageErrors, got %#v", err)
+	}
+	if len(perr.Errors) != 2 || perr.Errors[0].Page != 3 || perr.Errors[1].Page != 6 {
+		t.Errorf("expected pages 3 and 6 to fail, got %+v", perr.Errors)
+	}
+	if want := "2 of 8 queue pages failed: page 3: unavailable; page 6: unavailable"; perr.Error() != want {
+		t.Errorf("got %q, want %q", perr.Error(), want)
+	}
+}
+
+func TestFetchPagesDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := fetchPages(ctx, "queue", 1, 50, 2, retryPolicy{Attempts: 3, Backoff: time.Second}, func(page int) (func() error, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, errors.New("slow and failing")
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("paging should stop at the deadline, took %v", elapsed)
+	}
+	perr, ok := err.(*pageErrors)
+	if !ok || len(perr.Errors) != 50 {
+		t.Fatalf("expected all 50 pages to fail, got %v", err)
+	}
+	if perr.Errors[49].Err != context.DeadlineExceeded {
+		t.Errorf("expected unreached pages to fail with the deadline, got %v", perr.Errors[49].Err)
+	}
+}
+
+func TestCollectPagesEveryExchange(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Exchanges: 1200}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	payload, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 2}, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchanges := countEntities(t, payload, "exchange"); exchanges != 1200 {
+		t.Errorf("expected 1200 exchange entities, got %d", exchanges)
+	}
+	var pages []string
+	for _, uri := range fake.Requests() {
+		if strings.HasPrefix(uri, "/api/exchanges") {
+			pages = append(pages, uri)
+		}
+	}
+	if len(pages) != 3 {
+		t.Errorf("expected 3 pages of 500 exchanges, got %v", pages)
+	}
+}
+
+func TestPageIterator(t *testing.T) {
+	fake := fakeManagement{Exchanges: 250}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	it := newTestClient(t, srv.URL).NewPageIterator("exchanges", rabbithole.PageParameters{PageSize: 100}, nil)
+	var names []string
+	pages := 0
+	for it.Next() {
+		pages++
+		var xs []rabbithole.ExchangeInfo
+		if err := it.Page().Decode(&xs); err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range xs {
+			names = append(names, x.Name)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if pages != 3 || len(names) != 250 || names[249] != "exchange-249" {
+		t.Errorf("expected 250 exchanges over 3 pages, got %d over %d", len(names), pages)
+	}
+	if it.Next() {
+		t.Error("Next should keep returning false after the last page")
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// promSample is a single series value from the Prometheus text
+// exposition format.
+type promSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// promScrape holds the samples scraped from one node.
+type promScrape struct {
+	Endpoint  string
+	Node      string
+	Samples   []promSample
+	PerObject []promSample
+}
+
+// sumSamples adds up every sample of the named series, optionally restricted to
+// samples whose labels match all of the given label values.
+func sumSamples(samples []promSample, name string, match map[string]string) (float64, bool) {
+	var total float64
+	var found bool
+	for _, s := range samples {
+		if s.Name != name || !labelsMatch(s.Labels, match) {
+			continue
+		}
+		if math.IsNaN(s.Value) {
+			continue
+		}
+		total += s.Value
+		found = true
+	}
+	return total, found
+}
+
+func labelsMatch(labels map[string]string, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePrometheusText parses the Prometheus text exposition format
+// (version 0.0.4). Comment lines, including HELP and TYPE, are skipped
+// since the series names carry everything the mapping needs.
+func parsePrometheusText(r io.Reader) ([]promSample, error) {
+	var samples []promSample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parsePrometheusLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+func parsePrometheusLine(line string) (promSample, error) {
+	s := promSample{Labels: map[string]string{}}
+	n := strings.IndexAny(line, "{ \t")
+	if n <= 0 {
+		return s, fmt.Errorf("malformed sample %q", line)
+	}
+	s.Name = line[:n]
+	rest := line[n:]
+	if rest[0] == '{' {
+		var err error
+		rest, err = parsePrometheusLabels(rest[1:], s.Labels)
+		if err != nil {
+			return s, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("malformed value in %q", line)
+	}
+	value, err := parsePrometheusValue(fields[0])
+	if err != nil {
+		return s, err
+	}
+	s.Value = value
+	return s, nil
+}
+
+// parsePrometheusLabels reads label pairs up to the closing brace and
+// returns whatever follows it.
+func parsePrometheusLabels(in string, labels map[string]string) (string, error) {
+	for {
+		in = strings.TrimLeft(in, " \t,")
+		if in == "" {
+			return "", fmt.Errorf("unterminated label set")
+		}
+		if in[0] == '}' {
+			return in[1:], nil
+		}
+		eq := strings.IndexByte(in, '=')
+		if eq <= 0 || len(in) < eq+2 || in[eq+1] != '"' {
+			return "", fmt.Errorf("malformed label in %q", in)
+		}
+		name := strings.TrimSpace(in[:eq])
+		in = in[eq+2:]
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(in); i++ {
+			c := in[i]
+			if c == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(in[i])
+				}
+				continue
+			}
+			if c == '"' {
+				in = in[i+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return "", fmt.Errorf("unterminated value for label %q", name)
+		}
+		labels[name] = value.String()
+	}
+}
+
+func parsePrometheusValue(v string) (float64, error) {
+	switch v {
+	case "NaN":
+		return math.NaN(), nil
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+func scrapePrometheus(ctx context.Context, httpc *http.Client, url string) ([]promSample, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error %d scraping %s", res.StatusCode, url)
+	}
+	return parsePrometheusText(res.Body)
+}
+
+// scrapeNode fetches both the aggregated and per-object endpoints of a
+// single node's rabbitmq_prometheus listener.
+func scrapeNode(ctx context.Context, httpc *http.Client, endpoint string) (promScrape, error) {
+	endpoint = strings.TrimRight(endpoint, "/")
+	scrape := promScrape{Endpoint: endpoint}
+	var err error
+	if scrape.Samples, err = scrapePrometheus(ctx, httpc, endpoint+"/metrics"); err != nil {
+		return scrape, err
+	}
+	if scrape.PerObject, err = scrapePrometheus(ctx, httpc, endpoint+"/metrics/per-object"); err != nil {
+		return scrape, err
+	}
+	scrape.Node = endpoint
+	for _, s := range scrape.Samples {
+		if s.Name == "rabbitmq_identity_info" && s.Labels["rabbitmq_node"] != "" {
+			scrape.Node = s.Labels["rabbitmq_node"]
+			break
+		}
+	}
+	return scrape, nil
+}
+
+// scrapeNodes scrapes every configured node's Prometheus endpoint.
+// It fails unless every node could be scraped, before anything is
+// reported, so the caller can fall back to the management API.
+func scrapeNodes(ctx context.Context, cfg Config) ([]promScrape, error) {
+	if len(cfg.PrometheusEndpoints) == 0 {
+		return nil, fmt.Errorf("no RMQ_PROMETHEUS_ENDPOINTS configured")
+	}
+	// Endpoints are scraped concurrently, each within its own budget.
+	httpc := &http.Client{}
+	scrapes := make([]promScrape, len(cfg.PrometheusEndpoints))
+	errs := make([]error, len(cfg.PrometheusEndpoints))
+	var wg sync.WaitGroup
+	for n, endpoint := range cfg.PrometheusEndpoints {
+		wg.Add(1)
+		go func(n int, endpoint string) {
+			defer wg.Done()
+			nodeCtx, cancel := budgetContext(ctx, cfg.NodeTimeout)
+			defer cancel()
+			scrapes[n], errs[n] = scrapeNode(nodeCtx, httpc, endpoint)
+		}(n, endpoint)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scrapes, nil
+}
+
+// populatePrometheus maps the scraped series onto the overview, node,
+// queue and exchange entities.
+func populatePrometheus(i *integration.Integration, overview *metric.Set, cfg Config, scrapes []promScrape) error {
+	populatePrometheusOverview(overview, scrapes)
+	for _, scrape := range scrapes {
+		if err := populatePrometheusNode(i, cfg, scrape); err != nil {
+			return err
+		}
+	}
+	if err := populatePrometheusQueues(i, cfg, scrapes); err != nil {
+		return err
+	}
+	return populatePrometheusExchanges(i, cfg, scrapes)
+}
+
+func populatePrometheusOverview(ms *metric.Set, scrapes []promScrape) {
+	totals := func(name string) float64 {
+		var total float64
+		for _, scrape := range scrapes {
+			v, _ := sumSamples(scrape.Samples, name, nil)
+			total += v
+		}
+		return total
+	}
+
+	// Object Totals
+	ms.SetMetric("Queues", totals("rabbitmq_queues"), metric.GAUGE)
+	ms.SetMetric("Connections", totals("rabbitmq_connections"), metric.GAUGE)
+	ms.SetMetric("Channels", totals("rabbitmq_channels"), metric.GAUGE)
+	ms.SetMetric("Consumers", totals("rabbitmq_consumers"), metric.GAUGE)
+	//Queue Totals
+	ms.SetMetric("Messages", totals("rabbitmq_queue_messages"), metric.GAUGE)
+	ms.SetMetric("Messages Unacknowledged", totals("rabbitmq_queue_messages_unacked"), metric.GAUGE)
+	ms.SetMetric("Messages Ready", totals("rabbitmq_queue_messages_ready"), metric.GAUGE)
+	//Message Stats and Churn, reported as counters so the SDK derives the rate
+	for _, m := range prometheusOverviewRates {
+		var total float64
+		for _, series := range m.series {
+			total += totals(series)
+		}
+		ms.SetMetric(m.metric, total, metric.RATE)
+	}
+	//Dead lettering, RabbitMQ 3.10+, by the reason messages were dead-lettered
+	for _, reason := range []struct{ series, metric string }{
+		{"confirmed", "Dead Lettered Confirmed"},
+		{"delivery_limit", "Dead Lettered Delivery Limit"},
+		{"expired", "Dead Lettered Expired"},
+		{"maxlen", "Dead Lettered Maxlen"},
+		{"rejected", "Dead Lettered Rejected"},
+	} {
+		var total float64
+		var found bool
+		for _, scrape := range scrapes {
+			if v, ok := sumSamples(scrape.Samples, "rabbitmq_global_messages_dead_lettered_"+reason.series+"_total", nil); ok {
+				total += v
+				found = true
+			}
+		}
+		if found {
+			ms.SetMetric(reason.metric, total, metric.RATE)
+		}
+	}
+}
+
+// populatePrometheusCluster reports what rabbitmq_prometheus has no
+// cluster-wide series for from the management API: the running nodes and
+// partitions, read from the node list, and the exchange count, read from
+// the totals of a single-item page.
+func populatePrometheusCluster(e *integration.Entity, ms *metric.Set, rmqc managementClient, cfg Config) error {
+	xs, err := rmqc.ListNodes()
+	if err != nil {
+		return err
+	}
+	running := 0
+	for _, node := range xs {
+		if node.IsRunning {
+			running++
+		}
+	}
+	ms.SetMetric("Running", running, metric.GAUGE)
+	if err := populatePartitions(e, ms, xs, cfg); err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("columns", "name")
+	page, err := rmqc.ListPage("exchanges", rabbithole.PageParameters{PageSize: 1}.Values(params))
+	if err != nil {
+		return err
+	}
+	ms.SetMetric("Exchanges", page.TotalCount, metric.GAUGE)
+	return nil
+}
+
+// prometheusOverviewRates maps overview rates to the counters that back
+// them. The management API's deliveries and gets count the ones needing
+// an ack, and its deliver_get adds the no-ack ones to both.
+var prometheusOverviewRates = []struct {
+	metric string
+	series []string
+}{
+	{"Publish", []string{"rabbitmq_channel_messages_published_total"}},
+	{"Deliver", []string{"rabbitmq_channel_messages_delivered_ack_total"}},
+	{"Deliver Get", []string{
+		"rabbitmq_channel_messages_delivered_ack_total", "rabbitmq_channel_messages_delivered_total",
+		"rabbitmq_channel_get_ack_total", "rabbitmq_channel_get_total",
+	}},
+	{"Deliver No Ack", []string{"rabbitmq_channel_messages_delivered_total"}},
+	{"Get", []string{"rabbitmq_channel_get_ack_total"}},
+	{"Get No Ack", []string{"rabbitmq_channel_get_total"}},
+	{"Get Empty", []string{"rabbitmq_channel_get_empty_total"}},
+	{"Confirm", []string{"rabbitmq_channel_messages_confirmed_total"}},
+	{"Ack", []string{"rabbitmq_channel_messages_acked_total"}},
+	{"Redeliver", []string{"rabbitmq_channel_messages_redelivered_total"}},
+	{"Disk Reads", []string{"rabbitmq_queue_disk_reads_total"}},
+	{"Disk Writes", []string{"rabbitmq_queue_disk_writes_total"}},
+	{"Connection Created", []string{"rabbitmq_connections_opened_total"}},
+	{"Connection Closed", []string{"rabbitmq_connections_closed_total"}},
+	{"Channel Created", []string{"rabbitmq_channels_opened_total"}},
+	{"Channel Closed", []string{"rabbitmq_channels_closed_total"}},
+	{"Queue Declared", []string{"rabbitmq_queues_declared_total"}},
+	{"Queue Created", []string{"rabbitmq_queues_created_total"}},
+	{"Queue Deleted", []string{"rabbitmq_queues_deleted_total"}},
+}
+
+// prometheusNodeGauges and prometheusNodeRates map node entity metrics to
+// the rabbitmq_prometheus series that back them.
+var prometheusNodeGauges = []struct{ metric, series string }{
+	{"fd_used", "rabbitmq_process_open_fds"},
+	{"fd_total", "rabbitmq_process_max_fds"},
+	{"proc_used", "erlang_vm_process_count"},
+	{"proc_total", "erlang_vm_process_limit"},
+	{"sockets_used", "rabbitmq_process_open_tcp_sockets"},
+	{"sockets_total", "rabbitmq_process_max_tcp_sockets"},
+	{"mem_used", "rabbitmq_process_resident_memory_bytes"},
+	{"mem_limit", "rabbitmq_resident_memory_limit_bytes"},
+	{"disk_free", "rabbitmq_disk_space_available_bytes"},
+	{"disk_free_limit", "rabbitmq_disk_space_available_limit_bytes"},
+}
+
+var prometheusNodeRates = []struct{ metric, series string }{
+	{"io_read_rate", "rabbitmq_io_read_ops_total"},
+	{"io_read_bytes_rate", "rabbitmq_io_read_bytes_total"},
+	{"io_write_rate", "rabbitmq_io_write_ops_total"},
+	{"io_write_bytes_rate", "rabbitmq_io_write_bytes_total"},
+	{"io_sync_rate", "rabbitmq_io_sync_ops_total"},
+	{"io_seek_rate", "rabbitmq_io_seek_ops_total"},
+	{"io_reopen_rate", "rabbitmq_io_reopen_ops_total"},
+	{"gc_rate", "erlang_vm_statistics_garbage_collection_number_of_gcs"},
+	{"gc_bytes_reclaimed_rate", "erlang_vm_statistics_garbage_collection_bytes_reclaimed"},
+	{"context_switches_rate", "erlang_vm_statistics_context_switches"},
+	{"mnesia_ram_tx_rate", "rabbitmq_schema_db_ram_tx_total"},
+	{"mnesia_disk_tx_rate", "rabbitmq_schema_db_disk_tx_total"},
+	{"msg_store_read_rate", "rabbitmq_msg_store_read_total"},
+	{"msg_store_write_rate", "rabbitmq_msg_store_write_total"},
+	{"queue_index_read_rate", "rabbitmq_queue_index_read_ops_total"},
+	{"queue_index_write_rate", "rabbitmq_queue_index_write_ops_total"},
+	{"queue_index_journal_write_rate", "rabbitmq_queue_index_journal_write_ops_total"},
+	{"connection_created_rate", "rabbitmq_connections_opened_total"},
+	{"connection_closed_rate", "rabbitmq_connections_closed_total"},
+	{"channel_created_rate", "rabbitmq_channels_opened_total"},
+	{"channel_closed_rate", "rabbitmq_channels_closed_total"},
+	{"queue_declared_rate", "rabbitmq_queues_declared_total"},
+	{"queue_created_rate", "rabbitmq_queues_created_total"},
+	{"queue_deleted_rate", "rabbitmq_queues_deleted_total"},
+}
+
+func populatePrometheusNode(i *integration.Integration, cfg Config, scrape promScrape) error {
+	entityNode, err := i.Entity(nodeEntityName(cfg, scrape.Node), "node")
+	if err != nil {
+		return err
+	}
+	nodes := entityNode.NewMetricSet("Rabbitmq_Nodes", nodeTags(cfg, scrape.Node)...)
+	for _, m := range prometheusNodeGauges {
+		if v, ok := sumSamples(scrape.Samples, m.series, nil); ok {
+			nodes.SetMetric(m.metric, v, metric.GAUGE)
+		}
+	}
+	for _, m := range prometheusNodeRates {
+		if v, ok := sumSamples(scrape.Samples, m.series, nil); ok {
+			nodes.SetMetric(m.metric, v, metric.RATE)
+		}
+	}
+	return nil
+}
+
+// populatePrometheusQueues reports the per-object queue series. Queues
+// only appear on the node hosting their leader, so every node is visited.
+func populatePrometheusQueues(i *integration.Integration, cfg Config, scrapes []promScrape) error {
+	series := map[string]string{
+		"rabbitmq_queue_messages":         "messages",
+		"rabbitmq_queue_consumers":        "consumers",
+		"rabbitmq_queue_messages_ready":   "messages_ready",
+		"rabbitmq_queue_messages_unacked": "messages_unacknowledged",
+	}
+	type queueKey struct{ vhost, name string }
+	var order []queueKey
+	values := map[queueKey]map[string]float64{}
+	for _, scrape := range scrapes {
+		for _, s := range scrape.PerObject {
+			name, ok := series[s.Name]
+			if !ok || s.Labels["queue"] == "" || math.IsNaN(s.Value) {
+				continue
+			}
+			key := queueKey{s.Labels["vhost"], s.Labels["queue"]}
+			if values[key] == nil {
+				values[key] = map[string]float64{}
+				order = append(order, key)
+			}
+			values[key][name] += s.Value
+		}
+	}
+	for _, key := range order {
+		entityQueues, err := i.Entity(queueEntityName(cfg, key.vhost, key.name), "queue")
+		if err != nil {
+			return err
+		}
+		queues := entityQueues.NewMetricSet("Rabbitmq_Queues", cfg.Tags...)
+		for name, v := range values[key] {
+			queues.SetMetric(name, v, metric.GAUGE)
+		}
+	}
+	return nil
+}
+
+// publishCounter turns the sum of an exchange's per-channel publish
+// counters into a counter that only goes up. The sum falls when a channel
+// closes and its series goes away, so only growth since the previous run
+// is added to Total.
+type publishCounter struct {
+	Sum   float64
+	Total float64
+}
+
+// populatePrometheusExchanges derives exchange publish rates from the
+// per-channel, per-exchange publish counters of every node. The counters
+// of the exchanges seen are kept in cfg.State, in one map.
+func populatePrometheusExchanges(i *integration.Integration, cfg Config, scrapes []promScrape) error {
+	type exchangeKey struct{ vhost, name string }
+	var order []exchangeKey
+	published := map[exchangeKey]float64{}
+	for _, scrape := range scrapes {
+		for _, s := range scrape.PerObject {
+			if s.Name != "rabbitmq_channel_messages_published_total" {
+				continue
+			}
+			if _, ok := s.Labels["exchange"]; !ok {
+				continue
+			}
+			key := exchangeKey{s.Labels["vhost"], s.Labels["exchange"]}
+			if _, ok := published[key]; !ok {
+				order = append(order, key)
+			}
+			published[key] += s.Value
+		}
+	}
+	stateKey := "exchange_publishes:" + overviewEntityName(cfg)
+	var prev map[string]publishCounter
+	cfg.State.Get(stateKey, &prev)
+	counters := map[string]publishCounter{}
+	for _, key := range order {
+		name := exchangeEntityName(cfg, key.vhost, key.name)
+		c, ok := prev[name]
+		if !ok {
+			c.Total = published[key]
+		} else if published[key] > c.Sum {
+			c.Total += published[key] - c.Sum
+		}
+		c.Sum = published[key]
+		counters[name] = c
+
+		entityExchanges, err := i.Entity(name, "exchange")
+		if err != nil {
+			return err
+		}
+		exchanges := entityExchanges.NewMetricSet("Rabbitmq_Exchanges", cfg.Tags...)
+		exchanges.SetMetric("publish_in_rate", c.Total, metric.RATE)
+	}
+	cfg.State.Set(stateKey, counters)
+	return nil
+}
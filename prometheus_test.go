@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/attribute"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestParsePrometheusText(t *testing.T) {
+	input := `# HELP rabbitmq_queue_messages Sum of ready and unacknowledged messages
+# TYPE rabbitmq_queue_messages gauge
+rabbitmq_queue_messages{vhost="/",queue="a \"quoted\" name\\with\nescapes"} 12
+rabbitmq_connections 3 1571923830000
+rabbitmq_disk_space_available_bytes{} +Inf
+erlang_vm_memory_bytes_total{kind="system",} NaN
+
+`
+	samples, err := parsePrometheusText(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 4 {
+		t.Fatalf("expected 4 samples, got %d", len(samples))
+	}
+	if got := samples[0].Labels["queue"]; got != "a \"quoted\" name\\with\nescapes" {
+		t.Errorf("unexpected queue label %q", got)
+	}
+	if samples[0].Labels["vhost"] != "/" || samples[0].Value != 12 {
+		t.Errorf("unexpected sample %+v", samples[0])
+	}
+	if samples[1].Name != "rabbitmq_connections" || samples[1].Value != 3 {
+		t.Errorf("unexpected sample %+v", samples[1])
+	}
+	if !math.IsInf(samples[2].Value, 1) {
+		t.Errorf("expected +Inf, got %v", samples[2].Value)
+	}
+	if !math.IsNaN(samples[3].Value) || samples[3].Labels["kind"] != "system" {
+		t.Errorf("unexpected sample %+v", samples[3])
+	}
+}
+
+func TestParsePrometheusTextMalformed(t *testing.T) {
+	for _, input := range []string{
+		`rabbitmq_queues`,
+		`rabbitmq_queues{vhost="/" 1`,
+		`rabbitmq_queues{vhost=/} 1`,
+		`rabbitmq_queues one`,
+	} {
+		if _, err := parsePrometheusText(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error parsing %q", input)
+		}
+	}
+}
+
+// newFakePrometheusNode serves the recorded exposition of a single node.
+func newFakePrometheusNode() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			http.ServeFile(w, r, filepath.Join("testdata", "prometheus", "metrics.txt"))
+		case "/metrics/per-object":
+			http.ServeFile(w, r, filepath.Join("testdata", "prometheus", "per-object.txt"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestCollectPrometheusGolden(t *testing.T) {
+	node := newFakePrometheusNode()
+	defer node.Close()
+
+	// Running nodes, partitions, the exchange count and limits still come
+	// from the management API, whatever the number of endpoints scraped.
+	srv := newFakeManagement(&fakeManagement{
+		Nodes:       3,
+		Stopped:     1,
+		Partitions:  map[string][]string{"rabbit@node-0": {"rabbit@node-2"}, "rabbit@node-2": {"rabbit@node-0"}},
+		VhostLimits: []rabbithole.VhostLimitsInfo{{Vhost: "/", Value: rabbithole.VhostLimitsValues{"max-queues": 10}}},
+	})
+	defer srv.Close()
+
+	cfg := Config{Cluster: "test-cluster", Source: "prometheus", PrometheusEndpoints: []string{node.URL}}
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{Metrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "prometheus", payload)
+}
+
+func TestPrometheusPublishCounterSurvivesClosedChannels(t *testing.T) {
+	var perObject string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics":
+			http.ServeFile(w, r, filepath.Join("testdata", "prometheus", "metrics.txt"))
+		case "/metrics/per-object":
+			fmt.Fprint(w, perObject)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer node.Close()
+	srv := newFakeManagement(&fakeManagement{Nodes: 1})
+	defer srv.Close()
+	state := persist.NewInMemoryStore()
+	cfg := Config{Cluster: "test-cluster", Source: "prometheus", PrometheusEndpoints: []string{node.URL}, State: state}
+	name := exchangeEntityName(cfg, "/", "amq.direct")
+
+	// the busier channel closes, and the other one carries on publishing
+	for n, c := range []struct {
+		channels map[string]int
+		want     float64
+	}{
+		{map[string]int{"<0.937.0>": 4000, "<0.941.0>": 500}, 4500},
+		{map[string]int{"<0.941.0>": 600}, 4500},
+		{map[string]int{"<0.941.0>": 700}, 4600},
+	} {
+		perObject = ""
+		for channel, v := range c.channels {
+			perObject += fmt.Sprintf("rabbitmq_channel_messages_published_total{channel=%q,vhost=\"/\",exchange=\"amq.direct\"} %d\n", channel, v)
+		}
+		if _, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{Metrics: true}); err != nil {
+			t.Fatal(err)
+		}
+		var counters map[string]publishCounter
+		if _, err := state.Get("exchange_publishes:"+overviewEntityName(cfg), &counters); err != nil {
+			t.Fatal(err)
+		}
+		if got := counters[name].Total; got != c.want {
+			t.Errorf("run %d: got publish counter %v, want %v", n, got, c.want)
+		}
+	}
+}
+
+func TestCollectPrometheusTags(t *testing.T) {
+	node := newFakePrometheusNode()
+	defer node.Close()
+	srv := newFakeManagement(&fakeManagement{Nodes: 1})
+	defer srv.Close()
+
+	cfg := Config{
+		Cluster:             "test-cluster",
+		Source:              "prometheus",
+		PrometheusEndpoints: []string{node.URL},
+		Tags:                []attribute.Attribute{attribute.Attr("env", "prod")},
+	}
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{Metrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Data []struct {
+			Entity  struct{ Name, Type string }
+			Metrics []map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range doc.Data {
+		for _, ms := range e.Metrics {
+			if ms["env"] != "prod" {
+				t.Errorf("%s %s: %v is missing the env tag", e.Entity.Type, e.Entity.Name, ms["event_type"])
+			}
+		}
+	}
+}
+
+func TestCollectPrometheusFallback(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Exchanges: 1}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	cfg := Config{Cluster: "test-cluster", Workers: 1, Source: "prometheus", PrometheusEndpoints: []string{srv.URL + "/unreachable"}}
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{Metrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"Exchanges":1`) {
+		t.Errorf("expected the management API overview after falling back, got %s", payload)
+	}
+}
+
+func TestCollectPrometheusNodeBudget(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		http.ServeFile(w, r, filepath.Join("testdata", "prometheus", "metrics.txt"))
+	}))
+	defer slow.Close()
+	fake := fakeManagement{Nodes: 1, Exchanges: 1}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	cfg := Config{
+		Cluster:             "test-cluster",
+		Source:              "prometheus",
+		PrometheusEndpoints: []string{slow.URL, slow.URL},
+		NodeTimeout:         50 * time.Millisecond,
+	}
+	start := time.Now()
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{Metrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both endpoints are scraped at once, so the run only waits for one budget.
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("slow endpoints should be abandoned at their deadline, took %v", elapsed)
+	}
+	if !strings.Contains(string(payload), `"Exchanges":1`) {
+		t.Errorf("expected the management API overview after falling back, got %s", payload)
+	}
+}
+
+func TestPrometheusOverviewMatchesManagement(t *testing.T) {
+	// The same traffic as the management API and rabbitmq_prometheus count
+	// it, the latter split over two nodes.
+	stats := rabbithole.MessageStats{
+		Publish: 100, Deliver: 40, DeliverNoAck: 12, Get: 3, GetNoAck: 2, DeliverGet: 57,
+		GetEmpty: 1, Confirm: 90, Ack: 38, Redeliver: 5, DiskReads: 7, DiskWrites: 9,
+	}
+	nodes := []string{`
+rabbitmq_channel_messages_published_total 60
+rabbitmq_channel_messages_delivered_ack_total 25
+rabbitmq_channel_messages_delivered_total 12
+rabbitmq_channel_get_ack_total 3
+rabbitmq_channel_get_empty_total 1
+rabbitmq_channel_messages_confirmed_total 50
+rabbitmq_channel_messages_acked_total 24
+rabbitmq_channel_messages_redelivered_total 5
+rabbitmq_queue_disk_reads_total 7
+`, `
+rabbitmq_channel_messages_published_total 40
+rabbitmq_channel_messages_delivered_ack_total 15
+rabbitmq_channel_get_total 2
+rabbitmq_channel_messages_confirmed_total 40
+rabbitmq_channel_messages_acked_total 14
+rabbitmq_queue_disk_writes_total 9
+`}
+	var scrapes []promScrape
+	for _, text := range nodes {
+		samples, err := parsePrometheusText(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scrapes = append(scrapes, promScrape{Samples: samples})
+	}
+
+	management := map[string]int64{
+		"Publish":        stats.Publish,
+		"Deliver":        stats.Deliver,
+		"Deliver Get":    stats.DeliverGet,
+		"Deliver No Ack": stats.DeliverNoAck,
+		"Get":            stats.Get,
+		"Get No Ack":     stats.GetNoAck,
+		"Get Empty":      stats.GetEmpty,
+		"Confirm":        stats.Confirm,
+		"Ack":            stats.Ack,
+		"Redeliver":      stats.Redeliver,
+		"Disk Reads":     stats.DiskReads,
+		"Disk Writes":    stats.DiskWrites,
+	}
+	for _, m := range prometheusOverviewRates {
+		want, ok := management[m.metric]
+		if !ok {
+			continue
+		}
+		var got float64
+		for _, series := range m.series {
+			for _, scrape := range scrapes {
+				v, _ := sumSamples(scrape.Samples, series, nil)
+				got += v
+			}
+		}
+		if got != float64(want) {
+			t.Errorf("%s: Prometheus counts %v, the management API %d", m.metric, got, want)
+		}
+	}
+}
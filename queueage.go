@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/event"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// now is the clock queue ages are measured against.
+var now = time.Now
+
+// idleSinceLayouts are the formats idle_since comes in: the management
+// API's own, with unpadded month, day and hour and no zone, and RFC 3339.
+var idleSinceLayouts = []string{"2006-1-2 15:04:05", time.RFC3339}
+
+// parseIdleSince reads idle_since, taking a time without a zone to be in
+// the broker's time zone.
+func parseIdleSince(s string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range idleSinceLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// secondsSince returns the seconds from t to at, never negative, so a
+// clock running behind the broker's doesn't report negative ages.
+func secondsSince(t time.Time, at time.Time) float64 {
+	if d := at.Sub(t); d > 0 {
+		return d.Seconds()
+	}
+	return 0
+}
+
+// queueAges tracks, over one run, which queues' head message is older than
+// cfg.MessageAgeThreshold. The state holds one map per vhost of the queues
+// that were over it, plus the list of vhosts with such a map, and each is
+// rewritten from the queues seen this run so deleted queues and vhosts
+// drop out.
+type queueAges struct {
+	cfg Config
+
+	mu sync.Mutex
+	// prev is the state of each vhost seen, read on first use, and seen
+	// whether each queue seen is over the threshold now.
+	prev map[string]map[string]bool
+	seen map[string]map[string]bool
+}
+
+func newQueueAges(cfg Config) *queueAges {
+	return &queueAges{cfg: cfg, prev: map[string]map[string]bool{}, seen: map[string]map[string]bool{}}
+}
+
+func (a *queueAges) key(vhost string) string {
+	return "message_age:" + vhostEntityName(a.cfg, vhost)
+}
+
+func (a *queueAges) vhostsKey() string {
+	return "message_age_vhosts:" + overviewEntityName(a.cfg)
+}
+
+// track records whether q is over the threshold and reports whether it
+// went over since the previous run.
+func (a *queueAges) track(q rabbithole.QueueInfo, over bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev, ok := a.prev[q.Vhost]
+	if !ok {
+		a.cfg.State.Get(a.key(q.Vhost), &prev)
+		a.prev[q.Vhost] = prev
+		a.seen[q.Vhost] = map[string]bool{}
+	}
+	a.seen[q.Vhost][q.Name] = over
+	return over && !prev[q.Name]
+}
+
+// finish writes the state back. When not every queue page was read, the
+// queues and vhosts that weren't seen keep their entries, so their
+// events aren't sent again.
+func (a *queueAges) finish(complete bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var listed []string
+	a.cfg.State.Get(a.vhostsKey(), &listed)
+	var vhosts []string
+	for _, vhost := range listed {
+		if _, ok := a.seen[vhost]; ok {
+			continue
+		}
+		if complete {
+			a.cfg.State.Delete(a.key(vhost))
+		} else {
+			vhosts = append(vhosts, vhost)
+		}
+	}
+	for vhost, seen := range a.seen {
+		over := map[string]bool{}
+		for name, isOver := range seen {
+			if isOver {
+				over[name] = true
+			}
+		}
+		if !complete {
+			for name := range a.prev[vhost] {
+				if _, ok := seen[name]; !ok {
+					over[name] = true
+				}
+			}
+		}
+		if len(over) == 0 {
+			a.cfg.State.Delete(a.key(vhost))
+			continue
+		}
+		a.cfg.State.Set(a.key(vhost), over)
+		vhosts = append(vhosts, vhost)
+	}
+	sort.Strings(vhosts)
+	a.cfg.State.Set(a.vhostsKey(), vhosts)
+}
+
+// populateQueueAge reports how long the message at the head of the queue
+// has waited, when messages carry a timestamp, and how long the queue has
+// been idle. With ages set, an event is sent on the run where the head
+// message's age goes over cfg.MessageAgeThreshold.
+func populateQueueAge(e *integration.Entity, ms *metric.Set, q rabbithole.QueueInfo, cfg Config, ages *queueAges) error {
+	at := now()
+	if q.IdleSince != "" {
+		if since, ok := parseIdleSince(q.IdleSince, cfg.BrokerLocation); ok {
+			ms.SetMetric("idle_seconds", secondsSince(since, at), metric.GAUGE)
+		}
+	}
+	var age float64
+	if q.HeadMessageTimestamp > 0 {
+		age = secondsSince(time.Unix(int64(q.HeadMessageTimestamp), 0), at)
+		ms.SetMetric("oldest_message_age_seconds", age, metric.GAUGE)
+	}
+	if ages == nil || !ages.track(q, age > cfg.MessageAgeThreshold.Seconds()) {
+		return nil
+	}
+	summary := fmt.Sprintf("Oldest message in queue %s of vhost %s is %s old, over the %s threshold", q.Name, q.Vhost, time.Duration(age)*time.Second, cfg.MessageAgeThreshold)
+	return e.AddEvent(event.New(summary, "RabbitMQ"))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+// testNow is 1500000000 seconds after the epoch, the time the fake's
+// samples end at.
+var testNow = time.Unix(1500000000, 0).UTC()
+
+// fixClock measures queue ages against testNow until the returned
+// function is called.
+func fixClock() func() {
+	now = func() time.Time { return testNow }
+	return func() { now = time.Now }
+}
+
+func TestParseIdleSince(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*60*60)
+	cases := []struct {
+		value string
+		loc   *time.Location
+		want  time.Time
+		ok    bool
+	}{
+		{"2017-07-14 2:30:00", time.UTC, testNow.Add(-10 * time.Minute), true},
+		{"2017-07-14 02:30:00", time.UTC, testNow.Add(-10 * time.Minute), true},
+		{"2017-07-14 4:30:00", berlin, testNow.Add(-10 * time.Minute), true},
+		{"2017-07-14T02:30:00Z", berlin, testNow.Add(-10 * time.Minute), true},
+		{"yesterday", time.UTC, time.Time{}, false},
+	}
+	for _, c := range cases {
+		got, ok := parseIdleSince(c.value, c.loc)
+		if ok != c.ok || !got.Equal(c.want) {
+			t.Errorf("%s in %s: got %v, %v", c.value, c.loc, got, ok)
+		}
+	}
+}
+
+func TestMessageAgeEvent(t *testing.T) {
+	defer fixClock()()
+	fake := &fakeManagement{Nodes: 1, Queues: 1}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	cfg := Config{Cluster: "c", Workers: 1, State: persist.NewInMemoryStore(), MessageAgeThreshold: 5 * time.Minute}
+
+	// the head message ages past the threshold, stays there, is consumed
+	// and a later one crosses it again
+	for n, c := range []struct {
+		age   time.Duration
+		event bool
+	}{{time.Minute, false}, {10 * time.Minute, true}, {20 * time.Minute, false}, {0, false}, {6 * time.Minute, true}} {
+		fake.QueueHeadTimestamps = nil
+		if c.age > 0 {
+			fake.QueueHeadTimestamps = map[string]int64{"queue-000": testNow.Add(-c.age).Unix()}
+		}
+		payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if c.event {
+			want = []string{"Oldest message in queue queue-000 of vhost / is " + c.age.String() + " old, over the 5m0s threshold"}
+		}
+		if events := entityEvents(t, payload, "queue"); !reflect.DeepEqual(events, want) {
+			t.Errorf("run %d: got events %q", n, events)
+		}
+	}
+}
+
+func TestMessageAgeStateDropsDeletedQueues(t *testing.T) {
+	defer fixClock()()
+	fake := &fakeManagement{Nodes: 1}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	state := persist.NewInMemoryStore()
+	cfg := Config{Cluster: "c", Workers: 1, State: state, MessageAgeThreshold: 5 * time.Minute}
+	old := testNow.Add(-10 * time.Minute).Unix()
+	fake.QueueHeadTimestamps = map[string]int64{"queue-000": old, "queue-001": old, "queue-002": old}
+
+	// queues are deleted until none are left, and vhost test with them
+	for n, c := range []struct {
+		queues int
+		want   map[string]map[string]bool
+	}{
+		{3, map[string]map[string]bool{"/": {"queue-000": true, "queue-002": true}, "test": {"queue-001": true}}},
+		{1, map[string]map[string]bool{"/": {"queue-000": true}}},
+		{0, map[string]map[string]bool{}},
+	} {
+		fake.Queues = c.queues
+		if _, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, vhost := range []string{"/", "test"} {
+			var got map[string]bool
+			_, err := state.Get("message_age:"+vhostEntityName(cfg, vhost), &got)
+			if want, ok := c.want[vhost]; !ok && err != persist.ErrNotFound || ok && (err != nil || !reflect.DeepEqual(got, want)) {
+				t.Errorf("run %d: got state %v, %v for vhost %s", n, got, err, vhost)
+			}
+		}
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/caarlos0/env"
+	"github.com/jordanbcooper/newrelic-integration-rabbitmq/policy"
 	"github.com/jordanbcooper/rabbit-hole"
 	sdkArgs "github.com/newrelic/infra-integrations-sdk/args"
+	"github.com/newrelic/infra-integrations-sdk/data/attribute"
 	"github.com/newrelic/infra-integrations-sdk/data/inventory"
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
 	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/log"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+	"io/ioutil"
+	"net/http"
 	"net/url"
-	"strconv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type argumentList struct {
 	sdkArgs.DefaultArgumentList
+	Topology string `default:"" help:"Print the exchange routing graph as json or dot instead of collecting"`
 }
 
 type Config struct {
@@ -22,62 +37,527 @@ type Config struct {
 	Password string `env:"RMQ_PASSWORD"`
 	Host     string `env:"RMQ_HOSTNAME"`
 	Cluster  string `env:"RMQ_CLUSTER"`
+	// Name entities as versions before cluster-scoped entity names did,
+	// for dashboards and alerts built on the old names.
+	LegacyEntityNames bool `env:"RMQ_LEGACY_ENTITY_NAMES"`
+	// Read the credentials from files, e.g. a mounted Kubernetes or BOSH
+	// secret, instead of RMQ_USERNAME and RMQ_PASSWORD.
+	UserFile     string `env:"RMQ_USERNAME_FILE"`
+	PasswordFile string `env:"RMQ_PASSWORD_FILE"`
+	// Read the credentials from a Vault KV secret instead.
+	VaultAddr        string `env:"RMQ_VAULT_ADDR"`
+	VaultToken       string `env:"RMQ_VAULT_TOKEN"`
+	VaultTokenFile   string `env:"RMQ_VAULT_TOKEN_FILE"`
+	VaultPath        string `env:"RMQ_VAULT_PATH"`
+	VaultUsernameKey string `env:"RMQ_VAULT_USERNAME_KEY" envDefault:"username"`
+	VaultPasswordKey string `env:"RMQ_VAULT_PASSWORD_KEY" envDefault:"password"`
+	// Authentication to the management API: "basic" with the credentials
+	// above, "bearer" with a static token or token file, or "oauth2" with
+	// the client credentials grant for the rabbitmq_auth_backend_oauth2 plugin.
+	Auth                  string   `env:"RMQ_AUTH" envDefault:"basic"`
+	BearerToken           string   `env:"RMQ_BEARER_TOKEN"`
+	BearerTokenFile       string   `env:"RMQ_BEARER_TOKEN_FILE"`
+	OAuthTokenURL         string   `env:"RMQ_OAUTH_TOKEN_URL"`
+	OAuthClientID         string   `env:"RMQ_OAUTH_CLIENT_ID"`
+	OAuthClientSecret     string   `env:"RMQ_OAUTH_CLIENT_SECRET"`
+	OAuthClientSecretFile string   `env:"RMQ_OAUTH_CLIENT_SECRET_FILE"`
+	OAuthScopes           []string `env:"RMQ_OAUTH_SCOPES" envSeparator:","`
+	// Each queue page is retried PageRetries times, waiting PageBackoff
+	// before the first retry and doubling it after that. Paging stops once
+	// QueueTimeout has passed; zero means no deadline.
+	PageRetries  int           `env:"RMQ_PAGE_RETRIES" envDefault:"2"`
+	PageBackoff  time.Duration `env:"RMQ_PAGE_BACKOFF" envDefault:"500ms"`
+	QueueTimeout time.Duration `env:"RMQ_QUEUE_TIMEOUT" envDefault:"60s"`
+	// Every management API GET that fails with a transport error or a
+	// 500, 502, 503 or 504 is retried up to RetryAttempts times in total.
+	RetryAttempts int           `env:"RMQ_RETRY_ATTEMPTS" envDefault:"3"`
+	RetryBackoff  time.Duration `env:"RMQ_RETRY_BACKOFF" envDefault:"250ms"`
+	// Time budget for each management API collector and for each
+	// Prometheus endpoint, so a slow node only holds up its own part of
+	// the run. Zero means no deadline.
+	NodeTimeout time.Duration `env:"RMQ_NODE_TIMEOUT" envDefault:"30s"`
+	// Open a new connection for every request, as versions before
+	// keep-alive support did.
+	DisableKeepAlive bool `env:"RMQ_DISABLE_KEEP_ALIVE"`
+	// Sample window, in seconds, requested from the management API.
+	// Zero disables sample mode and only the instantaneous rates are reported.
+	LengthsAge   int `env:"RMQ_LENGTHS_AGE"`
+	LengthsIncr  int `env:"RMQ_LENGTHS_INCR" envDefault:"5"`
+	MsgRatesAge  int `env:"RMQ_MSG_RATES_AGE"`
+	MsgRatesIncr int `env:"RMQ_MSG_RATES_INCR" envDefault:"5"`
+	// Collect only the columns that are reported and skip the stats DB
+	// where possible, at the cost of queue rates and sample windows.
+	LowOverhead bool `env:"RMQ_LOW_OVERHEAD"`
+	// Pick the queue page size and worker count from the total queue count.
+	AdaptivePaging bool `env:"RMQ_ADAPTIVE_PAGING"`
+	// Data source for metrics: "management" or "prometheus". The
+	// management API is used as a fallback when scraping fails. Prometheus
+	// has no per-object data for the dead-letter, queue limit, policy,
+	// dead-end exchange, unroutable message and message age metrics, so
+	// they are not reported in that mode.
+	Source              string   `env:"RMQ_SOURCE" envDefault:"management"`
+	PrometheusEndpoints []string `env:"RMQ_PROMETHEUS_ENDPOINTS" envSeparator:","`
+	// Serve management API responses from a directory of recordings
+	// instead of RMQ_HOSTNAME, or save every response into one.
+	ReplayDir string `env:"RMQ_REPLAY_DIR"`
+	RecordDir string `env:"RMQ_RECORD_DIR"`
+	// Find the management endpoints through the Kubernetes API instead of
+	// RMQ_HOSTNAME. Pods (or services) matching the label selector are
+	// grouped into clusters by the value of the cluster label.
+	Discovery         string `env:"RMQ_DISCOVERY"`
+	K8sKind           string `env:"RMQ_K8S_KIND" envDefault:"pods"`
+	K8sNamespace      string `env:"RMQ_K8S_NAMESPACE"`
+	K8sLabelSelector  string `env:"RMQ_K8S_LABEL_SELECTOR" envDefault:"app.kubernetes.io/component=rabbitmq"`
+	K8sClusterLabel   string `env:"RMQ_K8S_CLUSTER_LABEL" envDefault:"app.kubernetes.io/name"`
+	K8sManagementPort int    `env:"RMQ_K8S_MANAGEMENT_PORT" envDefault:"15672"`
+	K8sScheme         string `env:"RMQ_K8S_SCHEME" envDefault:"http"`
+	// Defaults to the in-cluster service account.
+	K8sAPIServer string `env:"RMQ_K8S_API_SERVER"`
+	K8sTokenFile string `env:"RMQ_K8S_TOKEN_FILE"`
+	K8sCAFile    string `env:"RMQ_K8S_CA_FILE"`
+	// A snapshot of the definitions is kept with the inventory and an
+	// event sent when they change. Exporting the whole cluster's needs the
+	// administrator tag; DefinitionsVhosts exports only those vhosts,
+	// without users and permissions.
+	DisableDefinitions bool     `env:"RMQ_DISABLE_DEFINITIONS"`
+	DefinitionsVhosts  []string `env:"RMQ_DEFINITIONS_VHOSTS" envSeparator:","`
+	// An event is sent when the message at the head of a queue gets older
+	// than MessageAgeThreshold; zero disables it. idle_since is in the
+	// broker's local time, read in BrokerTimezone.
+	MessageAgeThreshold time.Duration `env:"RMQ_MESSAGE_AGE_THRESHOLD"`
+	BrokerTimezone      string        `env:"RMQ_BROKER_TIMEZONE" envDefault:"UTC"`
+	// Tags are added to every metric set, and NodeTags to those of the
+	// node it is called with. They are set by discovery, not read from
+	// the environment.
+	Tags     []attribute.Attribute
+	NodeTags func(node string) []attribute.Attribute
+	// BrokerLocation is BrokerTimezone, loaded by collect.
+	BrokerLocation *time.Location
+	// State is kept between runs, e.g. to send an event only when a
+	// condition starts. main shares it with the SDK's rate store; when nil
+	// each collect starts from an empty one.
+	State persist.Storer
+	// TokenDir keeps OAuth 2 tokens between runs, each in a file only the
+	// integration's user can read rather than in the shared State. main
+	// puts it next to the state file; when empty a token lasts one run.
+	TokenDir string
 }
 
 const (
 	integrationName    = "com.org.rabbitmq"
 	integrationVersion = "1.0.0"
+	// Upper bound on the wait between two attempts of the same request.
+	maxRetryBackoff = 5 * time.Second
 )
 
-var args argumentList
+// managementClient is the part of the management API the collectors use.
+// It is satisfied by rabbitholeClient.
+type managementClient interface {
+	Overview() (*rabbithole.Overview, error)
+	OverviewWithParameters(params url.Values) (*rabbithole.Overview, error)
+	ListNodes() ([]rabbithole.NodeInfo, error)
+	ListBindings() ([]rabbithole.BindingInfo, error)
+	ListPolicies() ([]rabbithole.Policy, error)
+	ListOperatorPolicies() ([]rabbithole.Policy, error)
+	GetClusterName() (*rabbithole.ClusterName, error)
+	GetDefinitions() (*rabbithole.Definitions, error)
+	GetDefinitionsIn(vhost string) (*rabbithole.Definitions, error)
+	ListVhostLimits() ([]rabbithole.VhostLimitsInfo, error)
+	ListUserLimits() ([]rabbithole.UserLimitsInfo, error)
+	PagedListQueuesWithParameters(params url.Values) (rabbithole.PagedQueueInfo, error)
+	ListPage(path string, params url.Values) (rabbithole.Page, error)
+	Retries() uint64
+	WithContext(ctx context.Context) managementClient
+	// WithoutRetries returns a copy that sends every request once, for
+	// callers that retry on their own.
+	WithoutRetries() managementClient
+}
 
-var cfg = Config{}
+// rabbitholeClient is a *rabbithole.Client whose WithContext returns a
+// managementClient, so a bound client can stand in for any other.
+type rabbitholeClient struct {
+	*rabbithole.Client
+}
+
+func (c rabbitholeClient) WithContext(ctx context.Context) managementClient {
+	return rabbitholeClient{c.Client.WithContext(ctx)}
+}
+
+func (c rabbitholeClient) WithoutRetries() managementClient {
+	c2 := c.Client.WithContext(c.Context())
+	c2.SetRetryPolicy(rabbithole.RetryPolicy{})
+	return rabbitholeClient{c2}
+}
+
+var args argumentList
 
 func main() {
 
-	i, err := integration.New(integrationName, integrationVersion, integration.Args(&args))
+	state, err := persist.NewFileStore(persist.DefaultPath(integrationName), log.NewStdErr(false), persist.DefaultTTL)
 	panicOnErr(err)
-	env.Parse(&cfg)
-	entityOverview, err := i.Entity(cfg.Cluster, "cluster_overview")
+	i, err := integration.New(integrationName, integrationVersion, integration.Args(&args), integration.Storer(state), integration.Synchronized())
 	panicOnErr(err)
+	cfg := Config{State: state, TokenDir: filepath.Dir(persist.DefaultPath(integrationName))}
+	panicOnErr(env.Parse(&cfg))
+	ctx := context.Background()
+	panicOnErr(loadCredentials(ctx, &cfg))
 
-	if args.All() || args.Inventory {
+	if args.Topology != "" {
+		if cfg.Discovery != "" {
+			panicOnErr(fmt.Errorf("--topology reads a single cluster from RMQ_HOSTNAME and can't be used with RMQ_DISCOVERY"))
+		}
+		rmqc, err := rmqClient(cfg)
+		panicOnErr(err)
+		panicOnErr(writeTopology(ctx, os.Stdout, rmqc, cfg, args.Topology))
+		return
+	}
 
-		populateInventory(entityOverview.Inventory)
+	switch cfg.Discovery {
+	case "":
+		rmqc, err := rmqClient(cfg)
+		panicOnErr(err)
+		panicOnErr(collect(ctx, i, rmqc, cfg, args))
+	case "kubernetes":
+		panicOnErr(collectDiscovered(ctx, i, cfg, args))
+	default:
+		panicOnErr(fmt.Errorf("unknown RMQ_DISCOVERY %q, expected kubernetes", cfg.Discovery))
+	}
+	panicOnErr(i.Publish())
+}
 
+// collect populates the integration with everything args asks for. Queue
+// pages that can't be fetched are logged and the rest are still reported.
+func collect(ctx context.Context, i *integration.Integration, rmqc managementClient, cfg Config, args argumentList) error {
+	cfg.Cluster = clusterIdentity(ctx, rmqc, cfg)
+	if cfg.State == nil {
+		cfg.State = persist.NewInMemoryStore()
+	}
+	if cfg.BrokerLocation == nil {
+		loc, err := time.LoadLocation(cfg.BrokerTimezone)
+		if err != nil {
+			log.Warn("Reading idle_since as UTC, RMQ_BROKER_TIMEZONE is not a known time zone: %v", err)
+			loc = time.UTC
+		}
+		cfg.BrokerLocation = loc
+	}
+	entityOverview, err := i.Entity(overviewEntityName(cfg), "cluster_overview")
+	if err != nil {
+		return err
+	}
+
+	// Bindings and policies are read once, for the binding inventory and
+	// the metrics that follow messages through them.
+	budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+	routes, err := loadRouting(budgeted)
+	cancel()
+	if err != nil {
+		log.Warn("Skipping the binding inventory and dead-letter, queue limit, policy and dead-end exchange metrics, routing could not be read: %v", err)
+		routes = nil
+	}
+
+	if args.All() || args.Inventory {
+		budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+		err := populateInventory(entityOverview.Inventory, budgeted)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if routes != nil {
+			if err := populateBindingInventory(i, routes.Bindings, cfg); err != nil {
+				return err
+			}
+		}
+		if !cfg.DisableDefinitions {
+			budgeted, cancel = withBudget(ctx, rmqc, cfg.NodeTimeout)
+			err = populateDefinitions(entityOverview, budgeted, cfg)
+			cancel()
+			if err != nil {
+				log.Warn("Skipping the definitions snapshot, definitions could not be read: %v", err)
+			}
+		}
 	}
 
 	if args.All() || args.Metrics {
-		// overview
-		overview := entityOverview.NewMetricSet("RabbitMQ_Overview")
-		populateOverview(overview)
-		// queues
-		populateQueues(i)
+		overview := entityOverview.NewMetricSet("RabbitMQ_Overview", cfg.Tags...)
+		scraped := false
+		if cfg.Source == "prometheus" {
+			// Whether to fall back is decided before anything is
+			// reported, so no metric set is written by both sources.
+			scrapes, err := scrapeNodes(ctx, cfg)
+			if err != nil {
+				log.Warn("Prometheus collection failed, falling back to the management API: %v", err)
+			} else {
+				log.Info("Collecting from Prometheus, which leaves out the dead-letter, queue limit, policy, dead-end exchange, unroutable message and message age metrics")
+				if err := populatePrometheus(i, overview, cfg, scrapes); err != nil {
+					return err
+				}
+				scraped = true
+			}
+		}
+		if scraped {
+			budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+			err := populatePrometheusCluster(entityOverview, overview, budgeted, cfg)
+			cancel()
+			if err != nil {
+				log.Warn("Skipping running node, partition and exchange count metrics, the management API could not be read: %v", err)
+			}
+		} else if err := populateManagementMetrics(ctx, i, entityOverview, overview, rmqc, cfg, routes); err != nil {
+			return err
+		}
+		// vhost and user limits
+		lctx, cancel := budgetContext(ctx, cfg.NodeTimeout)
+		err = populateResourceLimits(lctx, i, rmqc.WithContext(lctx), cfg)
+		cancel()
+		if err != nil {
+			log.Warn("Skipping vhost and user limits, they could not be read: %v", err)
+		}
+		overview.SetMetric("Request Retries", rmqc.Retries(), metric.GAUGE)
 	}
-	panicOnErr(i.Publish())
+	return nil
 }
 
-func rmqClient() *rabbithole.Client {
-	env.Parse(&cfg)
+// populateManagementMetrics reports the overview, node, exchange and queue
+// metrics from the management API, along with the dead-letter, queue
+// limit, policy and dead-end exchange metrics that need its per-object
+// data when routes is known.
+func populateManagementMetrics(ctx context.Context, i *integration.Integration, entityOverview *integration.Entity, overview *metric.Set, rmqc managementClient, cfg Config, routes *routing) error {
+	budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+	err := populateOverview(entityOverview, overview, budgeted, cfg)
+	cancel()
+	if err != nil {
+		return err
+	}
+	// nodes
+	budgeted, cancel = withBudget(ctx, rmqc, cfg.NodeTimeout)
+	err = populateNodes(i, budgeted, cfg)
+	cancel()
+	if err != nil {
+		return err
+	}
+	// Exchanges go before queues so dead-letter routing knows their
+	// types. Unused policies are only reported once every object has
+	// been checked.
+	complete := true
+	xctx, cancel := budgetContext(ctx, cfg.NodeTimeout)
+	err = populateExchanges(xctx, i, rmqc, cfg, routes)
+	cancel()
+	if err != nil {
+		if _, partial := err.(*pageErrors); !partial {
+			return err
+		}
+		log.Error("%v", err)
+		complete = false
+	}
+	// queues
+	if err := populateQueues(ctx, i, rmqc, cfg, routes); err != nil {
+		if _, partial := err.(*pageErrors); !partial {
+			return err
+		}
+		log.Error("%v", err)
+		complete = false
+	}
+	if routes != nil {
+		populatePolicyReport(overview, routes.PolicyReport, complete)
+	}
+	return nil
+}
+
+// budgetContext returns a context that expires after budget, or that is
+// only cancelled with ctx when budget is zero.
+func budgetContext(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget > 0 {
+		return context.WithTimeout(ctx, budget)
+	}
+	return context.WithCancel(ctx)
+}
+
+// withBudget returns rmqc bound to a budgetContext.
+func withBudget(ctx context.Context, rmqc managementClient, budget time.Duration) (managementClient, context.CancelFunc) {
+	ctx, cancel := budgetContext(ctx, budget)
+	return rmqc.WithContext(ctx), cancel
+}
+
+// nodeTags returns the tags for the metric sets of node: cfg.Tags and
+// those cfg.NodeTags adds for it.
+func nodeTags(cfg Config, node string) []attribute.Attribute {
+	if cfg.NodeTags == nil {
+		return cfg.Tags
+	}
+	return append(append([]attribute.Attribute(nil), cfg.Tags...), cfg.NodeTags(node)...)
+}
+
+// isNotFound reports whether err is a 404 from the management API, as
+// older brokers return for endpoints they don't have.
+func isNotFound(err error) bool {
+	rme, ok := err.(rabbithole.ErrorResponse)
+	return ok && rme.StatusCode == http.StatusNotFound
+}
+
+func rmqClient(cfg Config) (rabbitholeClient, error) {
 	rmqc, err := rabbithole.NewClient(cfg.Host, cfg.User, cfg.Password)
-	panicOnErr(err)
+	if err != nil {
+		return rabbitholeClient{}, err
+	}
+	rmqc.SetRetryPolicy(rabbithole.RetryPolicy{
+		MaxAttempts: cfg.RetryAttempts,
+		BaseDelay:   cfg.RetryBackoff,
+		MaxDelay:    maxRetryBackoff,
+	})
+	rmqc.DisableKeepAlive(cfg.DisableKeepAlive)
+	tokens, err := tokenSource(cfg)
+	if err != nil {
+		return rabbitholeClient{}, err
+	}
+	rmqc.SetTokenSource(tokens)
+	if cfg.ReplayDir != "" {
+		rmqc.SetTransport(&replayTransport{dir: cfg.ReplayDir})
+	} else if cfg.RecordDir != "" {
+		rmqc.SetTransport(&recordTransport{dir: cfg.RecordDir, next: rmqc.Transport()})
+	}
 
-	return rmqc
+	return rabbitholeClient{rmqc}, nil
 }
 
-func populateInventory(i *inventory.Inventory) {
-	rmqc := rmqClient()
+// tokenSource returns the bearer token source for cfg.Auth, or nil for
+// basic auth.
+func tokenSource(cfg Config) (rabbithole.TokenSource, error) {
+	switch cfg.Auth {
+	case "", "basic":
+		return nil, nil
+	case "bearer":
+		if cfg.BearerTokenFile != "" {
+			return rabbithole.TokenFile(cfg.BearerTokenFile), nil
+		}
+		if cfg.BearerToken == "" {
+			return nil, fmt.Errorf("RMQ_AUTH=bearer needs RMQ_BEARER_TOKEN or RMQ_BEARER_TOKEN_FILE")
+		}
+		return rabbithole.StaticToken(cfg.BearerToken), nil
+	case "oauth2":
+		if cfg.OAuthTokenURL == "" {
+			return nil, fmt.Errorf("RMQ_AUTH=oauth2 needs RMQ_OAUTH_TOKEN_URL")
+		}
+		secret := cfg.OAuthClientSecret
+		if cfg.OAuthClientSecretFile != "" {
+			var err error
+			if secret, err = readSecretFile(cfg.OAuthClientSecretFile); err != nil {
+				return nil, err
+			}
+		}
+		cc := &rabbithole.ClientCredentials{
+			TokenURL:     cfg.OAuthTokenURL,
+			ClientID:     cfg.OAuthClientID,
+			ClientSecret: secret,
+			Scopes:       cfg.OAuthScopes,
+		}
+		if cfg.TokenDir == "" {
+			return cc, nil
+		}
+		return newStoredToken(cc, filepath.Join(cfg.TokenDir, tokenFileName(cfg))), nil
+	}
+	return nil, fmt.Errorf("unknown RMQ_AUTH %q, expected basic, bearer or oauth2", cfg.Auth)
+}
+
+// oauthToken is an OAuth 2 token as kept in its file in cfg.TokenDir.
+type oauthToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// tokenFileName names the file the token of the client in cfg is kept in.
+// The token URL, client and scopes are hashed, so clients never share a
+// file and the name is safe on any file system.
+func tokenFileName(cfg Config) string {
+	sum := sha256.Sum256([]byte(entityKey(cfg.OAuthTokenURL, cfg.OAuthClientID, strings.Join(cfg.OAuthScopes, " "))))
+	return "oauth2-token-" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+// storedToken keeps the token of a ClientCredentials in a file, so every
+// run reuses it until shortly before it expires instead of requesting a
+// new one. The file is readable by its owner only, as anyone holding the
+// token can call the management API until it expires.
+type storedToken struct {
+	*rabbithole.ClientCredentials
+	path string
+
+	mu    sync.Mutex
+	saved string
+}
+
+func newStoredToken(cc *rabbithole.ClientCredentials, path string) *storedToken {
+	var stored oauthToken
+	if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &stored) == nil && stored.Token != "" {
+		cc.SetToken(stored.Token, stored.Expiry)
+		return &storedToken{ClientCredentials: cc, path: path, saved: stored.Token}
+	}
+	return &storedToken{ClientCredentials: cc, path: path}
+}
+
+// Token returns the cached token, or a new one, and saves a new one to
+// the token file. A token that can't be saved is still used for this run.
+func (t *storedToken) Token(ctx context.Context) (string, error) {
+	token, err := t.ClientCredentials.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token != t.saved {
+		_, expiry := t.CachedToken()
+		if err := writePrivateFile(t.path, oauthToken{Token: token, Expiry: expiry}); err != nil {
+			log.Warn("OAuth 2 token is not kept for the next run: %v", err)
+		}
+		t.saved = token
+	}
+	return token, nil
+}
+
+// writePrivateFile writes v as JSON to path, readable by its owner only.
+// It is written to a temporary file first, which ioutil.TempFile creates
+// with mode 0600, so a reader never sees half of it.
+func writePrivateFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func populateInventory(i *inventory.Inventory, rmqc managementClient) error {
 	res, err := rmqc.Overview()
-	panicOnErr(err)
+	if err != nil {
+		return err
+	}
 
 	i.SetItem("Software Version", "value", res.ManagementVersion)
+	return nil
 }
 
-func populateOverview(ms *metric.Set) {
-	rmqc := rmqClient()
-	res, err := rmqc.Overview()
-	panicOnErr(err)
+func populateOverview(e *integration.Entity, ms *metric.Set, rmqc managementClient, cfg Config) error {
+	res, err := rmqc.OverviewWithParameters(sampleParameters(cfg))
+	if err != nil {
+		return err
+	}
 	xs, err := rmqc.ListNodes()
+	if err != nil {
+		return err
+	}
 	//Cluster Running Count (GET ME INTO A FUNCTION!)
 	var runCount = 0
 	var nodeCount = len(xs)
@@ -112,69 +592,254 @@ func populateOverview(ms *metric.Set) {
 	//Message Stats
 	ms.SetMetric("Publish", res.MessageStats.PublishDetails.Rate, metric.GAUGE)
 	ms.SetMetric("Deliver", res.MessageStats.DeliverDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Deliver Get", res.MessageStats.DeliverGetDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Deliver No Ack", res.MessageStats.DeliverNoAckDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Get", res.MessageStats.GetDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Get No Ack", res.MessageStats.GetNoAckDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Get Empty", res.MessageStats.GetEmptyDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Confirm", res.MessageStats.ConfirmDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Ack", res.MessageStats.AckDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Redeliver", res.MessageStats.RedeliverDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Disk Reads", res.MessageStats.DiskReadsDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Disk Writes", res.MessageStats.DiskWritesDetails.Rate, metric.GAUGE)
+	//Churn, RabbitMQ 3.8+
+	churn := res.ChurnRates
+	ms.SetMetric("Connection Created", churn.ConnectionCreatedDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Connection Closed", churn.ConnectionClosedDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Channel Created", churn.ChannelCreatedDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Channel Closed", churn.ChannelClosedDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Queue Declared", churn.QueueDeclaredDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Queue Created", churn.QueueCreatedDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Queue Deleted", churn.QueueDeletedDetails.Rate, metric.GAUGE)
 	//Cluster Status
 	ms.SetMetric("Running", runCount, metric.GAUGE)
+	if err := populatePartitions(e, ms, xs, cfg); err != nil {
+		return err
+	}
+	if err := populateUnroutable(e, ms, res, cfg); err != nil {
+		return err
+	}
+	//Sample Windows
+	s, ok := lengthStats(res.QueueTotals.MessagesDetails)
+	setWindowMetrics(ms, "Messages Min", "Messages Max", "Messages Avg", s, ok)
+	s, ok = lengthStats(res.QueueTotals.MessagesReadyDetails)
+	setWindowMetrics(ms, "Messages Ready Min", "Messages Ready Max", "Messages Ready Avg", s, ok)
+	s, ok = lengthStats(res.QueueTotals.MessagesUnacknowledgedDetails)
+	setWindowMetrics(ms, "Messages Unacknowledged Min", "Messages Unacknowledged Max", "Messages Unacknowledged Avg", s, ok)
+	s, ok = rateStats(res.MessageStats.PublishDetails)
+	setWindowMetrics(ms, "Publish Min", "Publish Max", "Publish Avg", s, ok)
+	s, ok = rateStats(res.MessageStats.DeliverDetails)
+	setWindowMetrics(ms, "Deliver Min", "Deliver Max", "Deliver Avg", s, ok)
+	return nil
+}
 
+func populateNodes(i *integration.Integration, rmqc managementClient, cfg Config) error {
+	xs, err := rmqc.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range xs {
+		if !node.IsRunning {
+			continue
+		}
+		entityNode, err := i.Entity(nodeEntityName(cfg, node.Name), "node")
+		if err != nil {
+			return err
+		}
+		nodes := entityNode.NewMetricSet("Rabbitmq_Nodes", nodeTags(cfg, node.Name)...)
+		// Resource usage
+		nodes.SetMetric("fd_used", node.FdUsed, metric.GAUGE)
+		nodes.SetMetric("fd_total", node.FdTotal, metric.GAUGE)
+		nodes.SetMetric("proc_used", node.ProcUsed, metric.GAUGE)
+		nodes.SetMetric("proc_total", node.ProcTotal, metric.GAUGE)
+		nodes.SetMetric("sockets_used", node.SocketsUsed, metric.GAUGE)
+		nodes.SetMetric("sockets_total", node.SocketsTotal, metric.GAUGE)
+		nodes.SetMetric("mem_used", node.MemUsed, metric.GAUGE)
+		nodes.SetMetric("mem_limit", node.MemLimit, metric.GAUGE)
+		nodes.SetMetric("disk_free", node.DiskFree, metric.GAUGE)
+		nodes.SetMetric("disk_free_limit", node.DiskFreeLimit, metric.GAUGE)
+		//I/O
+		nodes.SetMetric("io_read_rate", node.IOReadCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_read_bytes_rate", node.IOReadBytesDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_read_avg_time", node.IOReadAvgTime, metric.GAUGE)
+		nodes.SetMetric("io_write_rate", node.IOWriteCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_write_bytes_rate", node.IOWriteBytesDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_write_avg_time", node.IOWriteAvgTime, metric.GAUGE)
+		nodes.SetMetric("io_sync_rate", node.IOSyncCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_sync_avg_time", node.IOSyncAvgTime, metric.GAUGE)
+		nodes.SetMetric("io_seek_rate", node.IOSeekCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_seek_avg_time", node.IOSeekAvgTime, metric.GAUGE)
+		nodes.SetMetric("io_reopen_rate", node.IOReopenCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_file_handle_open_attempt_rate", node.IOFileHandleOpenAttemptCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("io_file_handle_open_attempt_avg_time", node.IOFileHandleOpenAttemptAvgTime, metric.GAUGE)
+		//GC and scheduler
+		nodes.SetMetric("gc_rate", node.GCNumDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("gc_bytes_reclaimed_rate", node.GCBytesReclaimedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("context_switches_rate", node.ContextSwitchesDetails.Rate, metric.GAUGE)
+		//Mnesia
+		nodes.SetMetric("mnesia_ram_tx_rate", node.MnesiaRAMTxCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("mnesia_disk_tx_rate", node.MnesiaDiskTxCountDetails.Rate, metric.GAUGE)
+		//Message store and queue index
+		nodes.SetMetric("msg_store_read_rate", node.MsgStoreReadCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("msg_store_write_rate", node.MsgStoreWriteCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_index_read_rate", node.QueueIndexReadCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_index_write_rate", node.QueueIndexWriteCountDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_index_journal_write_rate", node.QueueIndexJournalWriteCountDetails.Rate, metric.GAUGE)
+		//Churn
+		nodes.SetMetric("connection_created_rate", node.ConnectionCreatedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("connection_closed_rate", node.ConnectionClosedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("channel_created_rate", node.ChannelCreatedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("channel_closed_rate", node.ChannelClosedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_declared_rate", node.QueueDeclaredDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_created_rate", node.QueueCreatedDetails.Rate, metric.GAUGE)
+		nodes.SetMetric("queue_deleted_rate", node.QueueDeletedDetails.Rate, metric.GAUGE)
+	}
+	return nil
 }
 
-func worker(rmqc *rabbithole.Client, i *integration.Integration, workerId int, jobs <-chan int, results chan<- int) {
-	for j := range jobs {
-		values := url.Values{"page": {strconv.Itoa(j)}}
-		rs, err := rmqc.PagedListQueuesWithParameters(values)
-		panicOnErr(err)
-		for _, queue := range rs.Items {
-			vhostQueue := queue.Vhost + "/" + queue.Name
-			entityQueues, err := i.Entity(vhostQueue, "queue")
-			panicOnErr(err)
-			queues := entityQueues.NewMetricSet("Rabbitmq_Queues")
-			queues.SetMetric("messages", queue.Messages, metric.GAUGE)
+// populateQueuePage reports every queue on a single page of /api/queues.
+// When routes is known each queue's limits are resolved and it is handed
+// to dl to track dead-letter routing.
+func populateQueuePage(i *integration.Integration, cfg Config, routes *routing, dl *deadLetters, ages *queueAges, rs rabbithole.PagedQueueInfo) error {
+	for _, queue := range rs.Items {
+		entityQueues, err := i.Entity(queueEntityName(cfg, queue.Vhost, queue.Name), "queue")
+		if err != nil {
+			return err
+		}
+		queues := entityQueues.NewMetricSet("Rabbitmq_Queues", cfg.Tags...)
+		queues.SetMetric("messages", queue.Messages, metric.GAUGE)
+		// Low overhead mode reads neither consumers nor rates, and
+		// reporting them as zero would say the queue has no consumers.
+		if !cfg.LowOverhead {
 			queues.SetMetric("consumers", queue.Consumers, metric.GAUGE)
 			queues.SetMetric("message_rate", queue.MessagesDetails.Rate, metric.GAUGE)
-			queues.SetMetric("messages_ready", queue.MessagesReady, metric.GAUGE)
-			queues.SetMetric("messages_unacknowledged", queue.MessagesUnacknowledged, metric.GAUGE)
 		}
-		results <- j
+		queues.SetMetric("messages_ready", queue.MessagesReady, metric.GAUGE)
+		queues.SetMetric("messages_unacknowledged", queue.MessagesUnacknowledged, metric.GAUGE)
+		s, ok := lengthStats(queue.MessagesDetails)
+		setWindowMetrics(queues, "messages_min", "messages_max", "messages_avg", s, ok)
+		s, ok = lengthStats(queue.MessagesReadyDetails)
+		setWindowMetrics(queues, "messages_ready_min", "messages_ready_max", "messages_ready_avg", s, ok)
+		s, ok = lengthStats(queue.MessagesUnacknowledgedDetails)
+		setWindowMetrics(queues, "messages_unacknowledged_min", "messages_unacknowledged_max", "messages_unacknowledged_avg", s, ok)
+		s, ok = rateStats(queue.MessageStats.PublishDetails)
+		setWindowMetrics(queues, "publish_rate_min", "publish_rate_max", "publish_rate_avg", s, ok)
+		s, ok = rateStats(queue.MessageStats.DeliverGetDetails)
+		setWindowMetrics(queues, "deliver_get_rate_min", "deliver_get_rate_max", "deliver_get_rate_avg", s, ok)
+		if !cfg.LowOverhead {
+			if err := populateQueueAge(entityQueues, queues, queue, cfg, ages); err != nil {
+				return err
+			}
+		}
+		if routes != nil {
+			populateQueueLimits(queues, queue, resolveQueueLimits(queue, routes), !cfg.LowOverhead)
+			populatePolicyCheck(queues, queue.Policy, routes.PolicyReport.Check(policy.Object{
+				Vhost: queue.Vhost, Name: queue.Name, Kind: "queue", QueueType: queue.Type, Policy: queue.Policy,
+			}))
+			dl.track(queue, queues)
+		}
 	}
+	return nil
 }
 
-func populateQueues(i *integration.Integration) {
-	rmqc := rmqClient()
-	values := url.Values{"page": {"1"}}
-	// values := url.Values{}
+// populateQueues reads the page count and then fetches every page from a
+// pool of workers. Pages that still fail after their retries, or that were
+// not reached before cfg.QueueTimeout, are returned as a *pageErrors.
+// Dead-letter queues are resolved when routes is known.
+func populateQueues(ctx context.Context, i *integration.Integration, rmqc managementClient, cfg Config, routes *routing) error {
+	ctx, cancel := budgetContext(ctx, cfg.QueueTimeout)
+	defer cancel()
+	rmqc = rmqc.WithContext(ctx)
+
+	// Only the counts of this page are used, so the broker is spared
+	// computing its stats.
+	values := url.Values{"page": {"1"}, "columns": {"name"}, "disable_stats": {"true"}}
 	qs, err := rmqc.PagedListQueuesWithParameters(values)
-	panicOnErr(err)
-	results := make(chan int, qs.PageCount)
+	if err != nil {
+		return err
+	}
+	var ages *queueAges
+	if cfg.MessageAgeThreshold > 0 && !cfg.LowOverhead {
+		ages = newQueueAges(cfg)
+	}
 	if qs.PageCount == 0 {
-		env.Parse(&cfg)
-		noQueues := cfg.Cluster + "/no_queues"
-		entityQueues, err := i.Entity(noQueues, "queue")
-		panicOnErr(err)
-		queues := entityQueues.NewMetricSet("Rabbitmq_Queues")
+		if ages != nil {
+			ages.finish(true)
+		}
+		entityQueues, err := i.Entity(noQueuesEntityName(cfg), "queue")
+		if err != nil {
+			return err
+		}
+		queues := entityQueues.NewMetricSet("Rabbitmq_Queues", cfg.Tags...)
 		queues.SetMetric("queues", 0, metric.GAUGE)
-		return
+		return nil
 	}
-	// TODO allow QueueFetchWorkerCount to be configurable in boshrelease
-	// Should default to 1 in the boshrelease
-	env.Parse(&cfg)
+	pageSize := 0
+	pageCount := qs.PageCount
 	workerCount := cfg.Workers
-	if workerCount > qs.PageCount {
-		workerCount = qs.PageCount
+	if cfg.AdaptivePaging {
+		pageSize, pageCount, workerCount = adaptivePaging(qs, cfg.Workers)
 	}
 
-	jobs := make(chan int, workerCount)
-	for w := 1; w <= workerCount; w++ {
-		go worker(rmqc, i, w, jobs, results)
-
+	var dl *deadLetters
+	if routes != nil {
+		dl = newDeadLetters(routes, cfg)
 	}
-	for currentPage := 1; currentPage <= qs.PageCount; currentPage++ {
-		jobs <- currentPage
+	// Pages are retried by retries alone.
+	retries := retryPolicy{Attempts: cfg.PageRetries + 1, Backoff: cfg.PageBackoff}
+	pages := rmqc.WithoutRetries()
+	err = fetchPages(ctx, "queue", 1, pageCount, workerCount, retries, func(page int) (func() error, error) {
+		rs, err := pages.PagedListQueuesWithParameters(pagedQueueParameters(cfg, page, pageSize))
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return populateQueuePage(i, cfg, routes, dl, ages, rs) }, nil
+	})
+	if dl != nil {
+		dl.finish()
 	}
-	close(jobs)
-
-	for a := 1; a <= qs.PageCount; a++ {
-		<-results
+	if ages != nil {
+		ages.finish(err == nil)
 	}
+	return err
+}
 
+// populateExchanges pages through /api/exchanges with the same pool as
+// queues. When routes is known it flags dead-end exchanges and records
+// each exchange's type in routes. Pages that fail are returned as a
+// *pageErrors.
+func populateExchanges(ctx context.Context, i *integration.Integration, rmqc managementClient, cfg Config, routes *routing) error {
+	rmqc = rmqc.WithContext(ctx)
+	retries := retryPolicy{Attempts: cfg.PageRetries + 1, Backoff: cfg.PageBackoff}
+	return fetchAllPages(ctx, rmqc, "exchange", "exchanges", exchangeParameters(), maxPageSize, cfg.Workers, retries, func(page rabbithole.Page) error {
+		var xs []rabbithole.ExchangeInfo
+		if err := page.Decode(&xs); err != nil {
+			return err
+		}
+		for _, exchange := range xs {
+			entityExchanges, err := i.Entity(exchangeEntityName(cfg, exchange.Vhost, exchange.Name), "exchange")
+			if err != nil {
+				return err
+			}
+			exchanges := entityExchanges.NewMetricSet("Rabbitmq_Exchanges", cfg.Tags...)
+			exchanges.SetMetric("type", exchange.Type, metric.ATTRIBUTE)
+			exchanges.SetMetric("publish_in_rate", exchange.MessageStats.PublishInDetails.Rate, metric.GAUGE)
+			exchanges.SetMetric("publish_out_rate", exchange.MessageStats.PublishOutDetails.Rate, metric.GAUGE)
+			if routes != nil {
+				routes.setExchangeType(exchange.Vhost, exchange.Name, exchange.Type)
+				populatePolicyCheck(exchanges, exchange.Policy, routes.PolicyReport.Check(policy.Object{
+					Vhost: exchange.Vhost, Name: exchange.Name, Kind: "exchange", Policy: exchange.Policy,
+				}))
+				deadEnd := 0
+				if isDeadEnd(exchange, routes) {
+					deadEnd = 1
+				}
+				exchanges.SetMetric("dead_end", deadEnd, metric.GAUGE)
+			}
+		}
+		return nil
+	})
 }
 
 func panicOnErr(err error) {
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// runIntegration populates a new integration with fn and returns the
+// published payload.
+func runIntegration(t *testing.T, fn func(i *integration.Integration) error) ([]byte, error) {
+	var buf bytes.Buffer
+	i, err := integration.New(integrationName, integrationVersion, integration.Writer(&buf), integration.InMemoryStore(), integration.Synchronized())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fn(i); err != nil {
+		return nil, err
+	}
+	if err := i.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// runCollect runs a full collection against rmqc and returns the
+// published payload.
+func runCollect(t *testing.T, rmqc managementClient, cfg Config, args argumentList) ([]byte, error) {
+	return runIntegration(t, func(i *integration.Integration) error {
+		return collect(context.Background(), i, rmqc, cfg, args)
+	})
+}
+
+// canonicalPayload re-indents a payload and sorts its entities by type
+// and name, so the output of concurrent queue workers compares equal.
+func canonicalPayload(t *testing.T, payload []byte) []byte {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatalf("payload is not valid JSON: %v\n%s", err, payload)
+	}
+	data, _ := doc["data"].([]interface{})
+	key := func(n int) string {
+		entity, _ := data[n].(map[string]interface{})["entity"].(map[string]interface{})
+		return entity["type"].(string) + ":" + entity["name"].(string)
+	}
+	sort.SliceStable(data, func(a, b int) bool { return key(a) < key(b) })
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(out, '\n')
+}
+
+func assertGolden(t *testing.T, name string, payload []byte) {
+	path := filepath.Join("testdata", name+".golden")
+	got := canonicalPayload(t, payload)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("payload does not match %s\n--- got\n%s", path, got)
+	}
+}
+
+func newTestClient(t *testing.T, url string) rabbitholeClient {
+	rmqc, err := rmqClient(Config{Host: url, User: "guest", Password: "guest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rmqc
+}
+
+func TestCollectGolden(t *testing.T) {
+	defer fixClock()()
+	cases := []struct {
+		name string
+		fake *fakeManagement
+		cfg  Config
+		args argumentList
+	}{
+		{
+			name: "single_node_no_queues",
+			fake: &fakeManagement{Nodes: 1, Exchanges: 1},
+			cfg:  Config{Workers: 1},
+		},
+		{
+			name: "three_nodes_paged_queues",
+			fake: &fakeManagement{Nodes: 3, Stopped: 1, Queues: 12, PageSize: 5, Exchanges: 3},
+			cfg:  Config{Workers: 3},
+		},
+		{
+			name: "partitioned",
+			fake: &fakeManagement{Nodes: 3, Exchanges: 1, Partitions: map[string][]string{
+				"rabbit@node-0": {"rabbit@node-2"},
+				"rabbit@node-1": {"rabbit@node-2"},
+				"rabbit@node-2": {"rabbit@node-1", "rabbit@node-0"},
+			}},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "dead_letters",
+			fake: &fakeManagement{
+				Nodes:  1,
+				Queues: 4,
+				QueueArguments: map[string]map[string]interface{}{
+					"queue-000": {"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "queue-002"},
+				},
+				QueuePolicies: map[string]string{"queue-001": "dead-letter"},
+				Policies: []rabbithole.Policy{{
+					Vhost: "test", Name: "dead-letter", Pattern: "^queue-001$", ApplyTo: "queues",
+					Definition: rabbithole.PolicyDefinition{"dead-letter-exchange": "", "dead-letter-routing-key": "queue-003"},
+				}},
+			},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "queue_limits",
+			fake: &fakeManagement{
+				Nodes:  1,
+				Queues: 3,
+				QueueArguments: map[string]map[string]interface{}{
+					"queue-000": {"x-max-length": 10, "x-overflow": "reject-publish"},
+					"queue-002": {"x-max-length": 8},
+				},
+				QueuePolicies:         map[string]string{"queue-001": "limits"},
+				QueueOperatorPolicies: map[string]string{"queue-002": "caps"},
+				Policies: []rabbithole.Policy{{
+					Vhost: "test", Name: "limits", Pattern: "^queue-", ApplyTo: "queues",
+					Definition: rabbithole.PolicyDefinition{"max-length-bytes": 4096, "message-ttl": 60000, "overflow": "reject-publish"},
+				}},
+				OperatorPolicies: []rabbithole.Policy{{
+					Vhost: "/", Name: "caps", Pattern: ".*", ApplyTo: "queues",
+					Definition: rabbithole.PolicyDefinition{"max-length": 5, "expires": 3600000},
+				}},
+			},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "policy_checks",
+			fake: &fakeManagement{
+				Nodes:         1,
+				Queues:        3,
+				QueuePolicies: map[string]string{"queue-000": "catch-all"},
+				Policies: []rabbithole.Policy{
+					{Vhost: "/", Name: "catch-all", Pattern: ".*", ApplyTo: "queues"},
+					{Vhost: "/", Name: "queue-000", Pattern: "^queue-000$", ApplyTo: "queues", Priority: 5},
+					{Vhost: "/", Name: "typo", Pattern: "^qeue-", ApplyTo: "queues", Priority: 10},
+					{Vhost: "test", Name: "a", Pattern: "^queue-", ApplyTo: "all", Priority: 1},
+					{Vhost: "test", Name: "b", Pattern: "^queue-", ApplyTo: "all", Priority: 1},
+				},
+			},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "resource_limits",
+			fake: &fakeManagement{
+				Nodes:  1,
+				Queues: 3,
+				VhostLimits: []rabbithole.VhostLimitsInfo{
+					{Vhost: "/", Value: rabbithole.VhostLimitsValues{"max-connections": 4, "max-queues": 10}},
+					{Vhost: "test", Value: rabbithole.VhostLimitsValues{"max-queues": 1}},
+					{Vhost: "unlimited", Value: rabbithole.VhostLimitsValues{"max-connections": -1}},
+				},
+				UserLimits: []rabbithole.UserLimitsInfo{
+					{User: "app", Value: rabbithole.UserLimitsValues{"max-connections": 2, "max-channels": 10}},
+				},
+				Clients: []rabbithole.ConnectionInfo{
+					{Name: "c1", Vhost: "/", User: "app", Channels: 3},
+					{Name: "c2", Vhost: "/", User: "app", Channels: 5},
+					{Name: "c3", Vhost: "/", User: "monitor", Channels: 1},
+					{Name: "c4", Vhost: "test", User: "app", Channels: 1},
+				},
+			},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "queue_age",
+			fake: &fakeManagement{
+				Nodes:               1,
+				Queues:              3,
+				QueueHeadTimestamps: map[string]int64{"queue-001": testNow.Add(-90 * time.Second).Unix()},
+				QueueIdleSince:      map[string]string{"queue-000": "2017-07-14 2:30:00"},
+			},
+			cfg: Config{Workers: 1},
+		},
+		{
+			name: "low_overhead",
+			fake: &fakeManagement{Nodes: 1, Queues: 3, Exchanges: 1},
+			cfg:  Config{Workers: 1, LowOverhead: true},
+		},
+		{
+			name: "sample_window",
+			fake: &fakeManagement{Nodes: 1, Exchanges: 1},
+			cfg:  Config{Workers: 1, LengthsAge: 20, LengthsIncr: 5, MsgRatesAge: 20, MsgRatesIncr: 5},
+		},
+		{
+			name: "bindings_inventory",
+			fake: &fakeManagement{Nodes: 1, Bindings: testBindings},
+			args: func() argumentList {
+				var a argumentList
+				a.Inventory = true
+				return a
+			}(),
+		},
+		{
+			name: "inventory_only",
+			fake: &fakeManagement{Nodes: 1},
+			args: func() argumentList {
+				var a argumentList
+				a.Inventory = true
+				return a
+			}(),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newFakeManagement(c.fake)
+			defer srv.Close()
+
+			c.cfg.Cluster = "test-cluster"
+			payload, err := runCollect(t, newTestClient(t, srv.URL), c.cfg, c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, c.name, payload)
+		})
+	}
+}
+
+// countEntities returns the number of entities of the given type in a payload.
+func countEntities(t *testing.T, payload []byte, entityType string) int {
+	var doc struct {
+		Data []struct {
+			Entity struct{ Type string }
+		}
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, e := range doc.Data {
+		if e.Entity.Type == entityType {
+			count++
+		}
+	}
+	return count
+}
+
+// entityNames returns the name of every entity in payload.
+func entityNames(t *testing.T, payload []byte) []string {
+	var doc struct {
+		Data []struct {
+			Entity struct{ Name string }
+		}
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range doc.Data {
+		names = append(names, e.Entity.Name)
+	}
+	return names
+}
+
+func TestCollectPagesEveryQueue(t *testing.T) {
+	// Workers 0 is what an unset QUEUE_FETCH_WORKER_COUNT parses to.
+	for _, workers := range []int{0, 2} {
+		fake := fakeManagement{Nodes: 1, Queues: 250}
+		srv := newFakeManagement(&fake)
+
+		payload, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: workers}, argumentList{})
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queues := countEntities(t, payload, "queue"); queues != 250 {
+			t.Errorf("workers %d: expected 250 queue entities, got %d", workers, queues)
+		}
+	}
+}
+
+func TestCollectErrorStatus(t *testing.T) {
+	for _, path := range []string{"/api/overview", "/api/nodes", "/api/queues", "/api/exchanges"} {
+		t.Run(path, func(t *testing.T) {
+			fake := fakeManagement{Nodes: 1, Status: map[string]int{path: 503}}
+			srv := newFakeManagement(&fake)
+			defer srv.Close()
+
+			_, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 1}, argumentList{})
+			rme, ok := err.(rabbithole.ErrorResponse)
+			if !ok {
+				t.Fatalf("expected an ErrorResponse, got %#v", err)
+			}
+			if rme.StatusCode != 503 {
+				t.Errorf("expected status 503, got %d", rme.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCollectRetriesTransientErrors(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Failures: map[string]int{"/api/overview": 2, "/api/nodes": 1}}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	cfg := Config{Cluster: "c", Host: srv.URL, RetryAttempts: 3, RetryBackoff: time.Millisecond}
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := runCollect(t, rmqc, cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"Request Retries":3`) {
+		t.Errorf("expected 3 retries to be reported, got %s", payload)
+	}
+
+	// A request that keeps failing gives up after RetryAttempts.
+	fake.mu.Lock()
+	fake.Failures = map[string]int{"/api/overview": 3}
+	fake.mu.Unlock()
+	rmqc, _ = rmqClient(cfg)
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err == nil {
+		t.Error("expected the overview to fail after 3 attempts")
+	}
+}
+
+func TestTLSClientCountsRetries(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Failures: map[string]int{"/api/overview": 2}}
+	srv := httptest.NewTLSServer(&fake)
+	defer srv.Close()
+
+	client, err := rabbithole.NewTLSClient(srv.URL, "guest", "guest", srv.Client().Transport.(*http.Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetryPolicy(rabbithole.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	payload, err := runCollect(t, rabbitholeClient{client}, Config{Cluster: "c"}, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"Request Retries":2`) {
+		t.Errorf("expected 2 retries to be reported, got %s", payload)
+	}
+}
+
+func TestCollectReusesConnections(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		fake := fakeManagement{Nodes: 1, Queues: 1000, Exchanges: 1}
+		srv := newFakeManagement(&fake)
+
+		cfg := Config{Cluster: "c", Host: srv.URL, Workers: 2, DisableKeepAlive: disable}
+		rmqc, err := rmqClient(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+			t.Fatal(err)
+		}
+		srv.Close()
+
+		requests, connections := len(fake.Requests()), fake.Connections()
+		if disable && connections != requests {
+			t.Errorf("without keep-alive expected a connection per request, got %d for %d requests", connections, requests)
+		}
+		if !disable && connections > cfg.Workers {
+			t.Errorf("with keep-alive expected at most %d connections, got %d for %d requests", cfg.Workers, connections, requests)
+		}
+	}
+}
+
+func TestCollectSlowResponse(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Delay: 200 * time.Millisecond}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	rmqc := newTestClient(t, srv.URL)
+	rmqc.SetTimeout(50 * time.Millisecond)
+	if _, err := runCollect(t, rmqc, Config{Cluster: "c", Workers: 1}, argumentList{}); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+}
+
+func TestCollectNodeTimeout(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Delay: 500 * time.Millisecond}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", NodeTimeout: 50 * time.Millisecond}, argumentList{})
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("expected the overview to run out of budget, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("the request should be cancelled at the deadline, took %v", elapsed)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	fake := fakeManagement{Nodes: 2, Queues: 120, Exchanges: 2}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The columns, sample window and page size production requests, so
+	// the recording holds the same URLs.
+	cfg := Config{
+		Cluster: "c", Workers: 1, Host: srv.URL, RecordDir: dir, AdaptivePaging: true,
+		MsgRatesAge: 60, MsgRatesIncr: 5, LengthsAge: 60, LengthsIncr: 5,
+	}
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := runCollect(t, rmqc, cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntities(t, recorded, "queue"); n != 120 {
+		t.Fatalf("expected 120 queues while recording, got %d", n)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.ContainsAny(f.Name(), fileNameUnsafe) {
+			t.Errorf("%s can't be extracted on Windows", f.Name())
+		}
+	}
+
+	cfg.Host, cfg.RecordDir, cfg.ReplayDir = "", "", dir
+	rmqc, err = rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// collect only logs pages that fail, so they are fetched on their own
+	// first to catch any request missing from the recording.
+	_, err = runIntegration(t, func(i *integration.Integration) error {
+		if err := populateExchanges(context.Background(), i, rmqc, cfg, nil); err != nil {
+			return err
+		}
+		return populateQueues(context.Background(), i, rmqc, cfg, nil)
+	})
+	if err != nil {
+		t.Fatalf("replaying pages: %v", err)
+	}
+	replayed, err := runCollect(t, rmqc, cfg, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntities(t, replayed, "queue"); n != 120 {
+		t.Errorf("expected 120 queues while replaying, got %d", n)
+	}
+	if !bytes.Equal(canonicalPayload(t, recorded), canonicalPayload(t, replayed)) {
+		t.Errorf("replayed payload differs from recorded one\n--- recorded\n%s\n--- replayed\n%s", recorded, replayed)
+	}
+}
+
+func TestRecordQueuePage(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Queues: 3}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := Config{Cluster: "c", Host: srv.URL, RecordDir: dir, MsgRatesAge: 60, MsgRatesIncr: 5, LengthsAge: 60, LengthsIncr: 5}
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rmqc.PagedListQueuesWithParameters(pagedQueueParameters(cfg, 1, maxPageSize)); err != nil {
+		t.Fatalf("recording a queue page with every column: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || len(files[0].Name()) > maxRecordingName {
+		t.Fatalf("expected one recording with a short name, got %v", files)
+	}
+
+	cfg.RecordDir, cfg.ReplayDir = "", dir
+	rmqc, err = rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := rmqc.PagedListQueuesWithParameters(pagedQueueParameters(cfg, 1, maxPageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 3 {
+		t.Errorf("expected 3 replayed queues, got %d", len(page.Items))
+	}
+}
+
+func TestRecordRedactsDefinitions(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Users: []rabbithole.UserDefinition{{Name: "alice", PasswordHash: "secret-hash", HashingAlgorithm: "rabbit_password_hashing_sha256"}}}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	parent, err := ioutil.TempDir("", "rabbitmq-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "recording")
+	cfg := Config{Cluster: "c", Host: srv.URL, RecordDir: dir}
+	rmqc, err := rmqClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := rmqc.GetDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Users[0].PasswordHash != "secret-hash" {
+		t.Errorf("the client should still get the password hash, got %+v", d.Users)
+	}
+
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected a directory only its owner can read, got %v %v", info, err)
+	}
+	path := filepath.Join(dir, "definitions.json")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a recording only its owner can read, got %v %v", info, err)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "secret-hash") || !strings.Contains(string(body), "rabbit_password_hashing_sha256") {
+		t.Errorf("expected the password hash to be left out of the recording, got %s", body)
+	}
+}
+
+func TestRecordKeepsClientTransport(t *testing.T) {
+	fake := fakeManagement{Nodes: 1}
+	srv := httptest.NewTLSServer(&fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rabbitmq-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Only the server's own transport trusts its certificate.
+	client, err := rabbithole.NewTLSClient(srv.URL, "guest", "guest", srv.Client().Transport.(*http.Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetTransport(&recordTransport{dir: dir, next: client.Transport()})
+	if _, err := client.Overview(); err != nil {
+		t.Fatalf("recording through the TLS transport: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected the overview to be recorded, got %d files", len(files))
+	}
+}
+
+func TestCollectRetriesQueuePages(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Queues: 300, QueueFailures: map[int]int{2: 1, 3: 100}}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	cfg := Config{Cluster: "c", Workers: 2, PageRetries: 2, PageBackoff: time.Millisecond}
+	payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+	if err != nil {
+		t.Fatalf("a failed page should not fail the collection: %v", err)
+	}
+	// Page 3 never succeeds, so only its 100 queues are missing.
+	if queues := countEntities(t, payload, "queue"); queues != 200 {
+		t.Errorf("expected 200 queue entities, got %d", queues)
+	}
+}
+
+func TestCollectRetriesQueuePagesOnce(t *testing.T) {
+	fake := fakeManagement{Nodes: 1, Queues: 300, QueueFailures: map[int]int{3: 100}}
+	srv := newFakeManagement(&fake)
+	defer srv.Close()
+
+	// Pages are retried by the page policy and not again by the client.
+	cfg := Config{Cluster: "c", Workers: 2, PageRetries: 2, PageBackoff: time.Millisecond, RetryAttempts: 3, RetryBackoff: time.Millisecond}
+	rmqc, err := rmqClient(Config{Host: srv.URL, RetryAttempts: cfg.RetryAttempts, RetryBackoff: cfg.RetryBackoff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCollect(t, rmqc, cfg, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	for _, uri := range fake.Requests() {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path == "/api/queues" && u.Query().Get("page") == "3" {
+			requests++
+		}
+	}
+	if requests != cfg.PageRetries+1 {
+		t.Errorf("expected page 3 to be requested %d times, got %d", cfg.PageRetries+1, requests)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upper bound on the length of a recording's file name, well under the
+// 255 bytes most file systems allow.
+const maxRecordingName = 200
+
+// fileNameUnsafe are the characters, besides control characters, that
+// Windows doesn't allow in file names.
+const fileNameUnsafe = `<>:"\|?*`
+
+// escapeFileName percent-encodes the characters of name that can't be
+// used in a file name on every system recordings are taken to.
+func escapeFileName(name string) string {
+	var b strings.Builder
+	for n := 0; n < len(name); n++ {
+		c := name[n]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(fileNameUnsafe, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// recordingName maps a management API request onto the file it is
+// recorded in, e.g. "overview.json", "queues_%2F_orders.json",
+// "queues_%2F_order%5Fevents.json" or "queues%3Fcolumns=name&page=1.json".
+// Path segments stay percent-encoded, with their underscores escaped so
+// they can be joined by one, query parameters are sorted and characters
+// no file name may hold are escaped, so the same request always maps to
+// the same file and different requests to different files. Names that
+// would be too long, such as queue pages with every column, keep the
+// start of the path and end in a hash of the full name instead.
+func recordingName(u *url.URL) string {
+	path := u.Opaque
+	if path == "" {
+		path = u.EscapedPath()
+	}
+	if n := strings.Index(path, "/api/"); n >= 0 {
+		path = path[n+len("/api/"):]
+	}
+	path = strings.Replace(strings.Trim(path, "/"), "_", "%5F", -1)
+	path = strings.Replace(path, "/", "_", -1)
+	name := path
+	if query := u.Query(); len(query) > 0 {
+		encoded, err := url.QueryUnescape(query.Encode())
+		if err != nil {
+			encoded = query.Encode()
+		}
+		name += "?" + strings.Replace(encoded, "/", "%2F", -1)
+	}
+	name = escapeFileName(name)
+	if len(name)+len(".json") <= maxRecordingName {
+		return name + ".json"
+	}
+	sum := sha256.Sum256([]byte(name))
+	path = escapeFileName(path)
+	if len(path) > 64 {
+		path = path[:64]
+	}
+	return path + "~" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+// replayTransport answers management API requests from a directory of
+// recorded responses instead of a broker. Requests that were not
+// recorded get the 404 the management API would return.
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadFile(filepath.Join(t.dir, recordingName(req.URL)))
+	status := http.StatusOK
+	if os.IsNotExist(err) {
+		status = http.StatusNotFound
+		body = []byte(`{"error":"Object Not Found","reason":"Not Found"}`)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordTransport passes requests through to a live broker and saves
+// every successful response body so it can be replayed later. Recordings
+// are readable by their owner only and password hashes are left out of
+// exported definitions, as they are sent on as support archives.
+type recordTransport struct {
+	dir string
+	// next is the transport the client would use without recording.
+	next http.RoundTripper
+}
+
+// CloseIdleConnections closes the idle connections of next.
+func (t *recordTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface {
+		CloseIdleConnections()
+	}); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	recorded := body
+	if strings.HasPrefix(recordingName(req.URL), "definitions") {
+		if recorded, err = redactDefinitions(body); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(t.dir, recordingName(req.URL)), recorded, 0600); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// redactDefinitions removes the password hash of every user from an
+// exported definitions body.
+func redactDefinitions(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var d map[string]interface{}
+	if err := dec.Decode(&d); err != nil {
+		return nil, fmt.Errorf("recording definitions: %v", err)
+	}
+	users, _ := d["users"].([]interface{})
+	for _, u := range users {
+		if user, ok := u.(map[string]interface{}); ok {
+			delete(user, "password_hash")
+		}
+	}
+	return json.Marshal(d)
+}
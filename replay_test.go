@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRecordingName(t *testing.T) {
+	cases := []struct {
+		request, want string
+	}{
+		{"http://localhost:15672/api/overview", "overview.json"},
+		{"http://localhost:15672/api/queues/%2F/orders", "queues_%2F_orders.json"},
+		// underscores in a segment don't read as a segment boundary
+		{"http://localhost:15672/api/queues/a/b_c", "queues_a_b%5Fc.json"},
+		{"http://localhost:15672/api/queues/a_b/c", "queues_a%5Fb_c.json"},
+		{"http://localhost:15672/api/queues?page=1&columns=name", "queues%3Fcolumns=name&page=1.json"},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := recordingName(u); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.request, got, c.want)
+		}
+	}
+}
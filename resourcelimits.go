@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// connectionUsage is the number of open connections in each vhost and of
+// each user, and the channels each user has open on them.
+type connectionUsage struct {
+	mu               sync.Mutex
+	vhostConnections map[string]int
+	userConnections  map[string]int
+	userChannels     map[string]int
+}
+
+// countConnections pages through /api/connections with the same pool as
+// queues, reading only the columns needed to count them.
+func countConnections(ctx context.Context, rmqc managementClient, cfg Config) (*connectionUsage, error) {
+	usage := &connectionUsage{vhostConnections: map[string]int{}, userConnections: map[string]int{}, userChannels: map[string]int{}}
+	params := url.Values{}
+	params.Set("columns", "name,vhost,user,channels")
+	retries := retryPolicy{Attempts: cfg.PageRetries + 1, Backoff: cfg.PageBackoff}
+	err := fetchAllPages(ctx, rmqc, "connection", "connections", params, maxPageSize, cfg.Workers, retries, func(page rabbithole.Page) error {
+		var cs []rabbithole.ConnectionInfo
+		if err := page.Decode(&cs); err != nil {
+			return err
+		}
+		usage.mu.Lock()
+		defer usage.mu.Unlock()
+		for _, c := range cs {
+			usage.vhostConnections[c.Vhost]++
+			usage.userConnections[c.User]++
+			usage.userChannels[c.User] += c.Channels
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// countQueuesIn returns the number of queues in vhost, read from the
+// totals of a single-item page.
+func countQueuesIn(rmqc managementClient, vhost string) (int, error) {
+	params := url.Values{}
+	params.Set("columns", "name")
+	page, err := rmqc.ListPage("queues/"+rabbithole.PathEscape(vhost), rabbithole.PageParameters{PageSize: 1}.Values(params))
+	if err != nil {
+		return 0, err
+	}
+	return page.TotalCount, nil
+}
+
+// setLimits returns the limits that are set. RabbitMQ treats a negative
+// limit as no limit.
+func setLimits(limits map[string]int) map[string]int {
+	set := map[string]int{}
+	for key, limit := range limits {
+		if limit >= 0 {
+			set[key] = limit
+		}
+	}
+	return set
+}
+
+// populateLimitUsage reports a limit, what is counted against it and the
+// share of it in use.
+func populateLimitUsage(ms *metric.Set, name string, limit int, used int) {
+	ms.SetMetric("max_"+name, limit, metric.GAUGE)
+	ms.SetMetric(name, used, metric.GAUGE)
+	ms.SetMetric(name+"_used_percent", usedPercent(int64(used), int64(limit)), metric.GAUGE)
+}
+
+// populateResourceLimits reports the vhost limits on vhost entities and
+// the user limits on user entities, next to the connections, channels and
+// queues counted against them. Once a max-connections limit is reached
+// new connections are refused outright. Connections are only listed when
+// a connection or channel limit is set. Brokers without vhost limits
+// (before 3.7) or user limits (before 3.8.10) skip them.
+func populateResourceLimits(ctx context.Context, i *integration.Integration, rmqc managementClient, cfg Config) error {
+	vhostLimits, err := rmqc.ListVhostLimits()
+	if isNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	userLimits, err := rmqc.ListUserLimits()
+	if isNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	vhosts := map[string]map[string]int{}
+	users := map[string]map[string]int{}
+	needConnections := false
+	for _, l := range vhostLimits {
+		if limits := setLimits(l.Value); len(limits) > 0 {
+			vhosts[l.Vhost] = limits
+			_, limited := limits["max-connections"]
+			needConnections = needConnections || limited
+		}
+	}
+	for _, l := range userLimits {
+		if limits := setLimits(l.Value); len(limits) > 0 {
+			users[l.User] = limits
+			needConnections = true
+		}
+	}
+	var usage *connectionUsage
+	if needConnections {
+		if usage, err = countConnections(ctx, rmqc, cfg); err != nil {
+			return err
+		}
+	}
+
+	for vhost, limits := range vhosts {
+		e, err := i.Entity(vhostEntityName(cfg, vhost), "vhost")
+		if err != nil {
+			return err
+		}
+		ms := e.NewMetricSet("Rabbitmq_Vhosts", cfg.Tags...)
+		if limit, ok := limits["max-connections"]; ok {
+			populateLimitUsage(ms, "connections", limit, usage.vhostConnections[vhost])
+		}
+		if limit, ok := limits["max-queues"]; ok {
+			queues, err := countQueuesIn(rmqc, vhost)
+			if err != nil {
+				return err
+			}
+			populateLimitUsage(ms, "queues", limit, queues)
+		}
+	}
+	for user, limits := range users {
+		e, err := i.Entity(userEntityName(cfg, user), "user")
+		if err != nil {
+			return err
+		}
+		ms := e.NewMetricSet("Rabbitmq_Users", cfg.Tags...)
+		if limit, ok := limits["max-connections"]; ok {
+			populateLimitUsage(ms, "connections", limit, usage.userConnections[user])
+		}
+		if limit, ok := limits["max-channels"]; ok {
+			populateLimitUsage(ms, "channels", limit, usage.userChannels[user])
+		}
+	}
+	return nil
+}
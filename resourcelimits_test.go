@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+func TestResourceLimitsListConnectionsOnlyWhenLimited(t *testing.T) {
+	fake := &fakeManagement{
+		Nodes:       1,
+		Queues:      2,
+		VhostLimits: []rabbithole.VhostLimitsInfo{{Vhost: "/", Value: rabbithole.VhostLimitsValues{"max-queues": 5, "max-connections": -1}}},
+	}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+
+	if _, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 1}, argumentList{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range fake.Requests() {
+		if strings.HasPrefix(uri, "/api/connections") {
+			t.Errorf("connections listed without a connection limit: %s", uri)
+		}
+	}
+}
+
+func TestResourceLimitsFailureKeepsCollecting(t *testing.T) {
+	fake := &fakeManagement{
+		Nodes:       1,
+		Queues:      2,
+		VhostLimits: []rabbithole.VhostLimitsInfo{{Vhost: "/", Value: rabbithole.VhostLimitsValues{"max-connections": 5}}},
+		Status:      map[string]int{"/api/connections": 403},
+	}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+
+	payload, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 1}, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countEntities(t, payload, "queue"); n != 2 {
+		t.Errorf("expected both queues to be reported, got %d", n)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jordanbcooper/newrelic-integration-rabbitmq/policy"
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/log"
+)
+
+// routing is what the collectors need to know about how messages move
+// between exchanges and queues: the bindings, the exchange types and the
+// policies, all keyed by vhost and name.
+type routing struct {
+	Bindings []rabbithole.BindingInfo
+	// bindings from each exchange and into each queue
+	from map[[2]string][]rabbithole.BindingInfo
+	into map[[2]string][]rabbithole.BindingInfo
+	// ExchangeTypes is the type of every exchange.
+	ExchangeTypes    map[[2]string]string
+	Policies         map[[2]string]rabbithole.Policy
+	OperatorPolicies map[[2]string]rabbithole.Policy
+	// Resolver finds the policy that should apply to an object the broker
+	// didn't report one for.
+	Resolver *policy.Resolver
+	// PolicyReport checks every queue and exchange against the policy
+	// that should apply to it.
+	PolicyReport *policy.Report
+
+	mu sync.Mutex
+}
+
+func newRouting(bs []rabbithole.BindingInfo, xs []rabbithole.ExchangeInfo, ps []rabbithole.Policy) *routing {
+	r := &routing{
+		Bindings:         bs,
+		from:             map[[2]string][]rabbithole.BindingInfo{},
+		into:             map[[2]string][]rabbithole.BindingInfo{},
+		ExchangeTypes:    map[[2]string]string{},
+		Policies:         map[[2]string]rabbithole.Policy{},
+		OperatorPolicies: map[[2]string]rabbithole.Policy{},
+	}
+	for _, b := range bs {
+		r.from[[2]string{b.Vhost, b.Source}] = append(r.from[[2]string{b.Vhost, b.Source}], b)
+		if b.DestinationType == "queue" {
+			r.into[[2]string{b.Vhost, b.Destination}] = append(r.into[[2]string{b.Vhost, b.Destination}], b)
+		}
+	}
+	for _, x := range xs {
+		r.ExchangeTypes[[2]string{x.Vhost, x.Name}] = x.Type
+	}
+	for _, p := range ps {
+		r.Policies[[2]string{p.Vhost, p.Name}] = p
+	}
+	r.Resolver = policy.New(ps)
+	r.PolicyReport = policy.NewReport(r.Resolver)
+	return r
+}
+
+// loadRouting reads the bindings and policies. Exchange types are added
+// with setExchangeType while the exchanges are paged through. Operator
+// policies are optional: brokers before 3.7 don't have them, and a user
+// that can't read them only loses their stricter limits.
+func loadRouting(rmqc managementClient) (*routing, error) {
+	bs, err := rmqc.ListBindings()
+	if err != nil {
+		return nil, err
+	}
+	ps, err := rmqc.ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+	r := newRouting(bs, nil, ps)
+	ops, err := rmqc.ListOperatorPolicies()
+	if isNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		log.Warn("Operator policies could not be read, queue limits only reflect arguments and policies: %v", err)
+	}
+	for _, p := range ops {
+		r.OperatorPolicies[[2]string{p.Vhost, p.Name}] = p
+	}
+	return r, nil
+}
+
+// setExchangeType is safe to call from concurrent page workers.
+func (r *routing) setExchangeType(vhost string, name string, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ExchangeTypes[[2]string{vhost, name}] = kind
+}
+
+// policyDefinition returns the definition of the named policy, or nil.
+func (r *routing) policyDefinition(vhost string, name string) rabbithole.PolicyDefinition {
+	if name == "" {
+		return nil
+	}
+	return r.Policies[[2]string{vhost, name}].Definition
+}
+
+// operatorPolicyDefinition returns the definition of the named operator
+// policy, or nil.
+func (r *routing) operatorPolicyDefinition(vhost string, name string) rabbithole.PolicyDefinition {
+	if name == "" {
+		return nil
+	}
+	return r.OperatorPolicies[[2]string{vhost, name}].Definition
+}
+
+// routingKeysInto returns the routing keys messages can carry when they
+// reach the queue: the keys of its bindings, including the default
+// exchange's binding on the queue name.
+func (r *routing) routingKeysInto(vhost string, queue string) []string {
+	keys := []string{queue}
+	for _, b := range r.into[[2]string{vhost, queue}] {
+		if b.RoutingKey != queue {
+			keys = append(keys, b.RoutingKey)
+		}
+	}
+	return keys
+}
+
+// queueExists reports whether vhost has the named queue, going by the
+// binding from the default exchange that every queue has.
+func (r *routing) queueExists(vhost string, queue string) bool {
+	for _, b := range r.into[[2]string{vhost, queue}] {
+		if b.Source == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// queuesFor returns the queues that a message published to exchange with
+// one of keys would reach, following exchange to exchange bindings.
+// The default exchange only routes keys that name a queue.
+// Headers and plugin exchange types can't be evaluated without the
+// message, so every binding from them is followed.
+func (r *routing) queuesFor(vhost string, exchange string, keys []string) []string {
+	found := map[string]bool{}
+	visited := map[string]bool{}
+	var walk func(exchange string)
+	walk = func(exchange string) {
+		if visited[exchange] {
+			return
+		}
+		visited[exchange] = true
+		if exchange == "" {
+			for _, key := range keys {
+				if r.queueExists(vhost, key) {
+					found[key] = true
+				}
+			}
+			return
+		}
+		kind := r.ExchangeTypes[[2]string{vhost, exchange}]
+		for _, b := range r.from[[2]string{vhost, exchange}] {
+			if !bindingMatches(kind, b.RoutingKey, keys) {
+				continue
+			}
+			if b.DestinationType == "exchange" {
+				walk(b.Destination)
+			} else {
+				found[b.Destination] = true
+			}
+		}
+	}
+	walk(exchange)
+
+	queues := make([]string, 0, len(found))
+	for q := range found {
+		queues = append(queues, q)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+func bindingMatches(kind string, bindingKey string, keys []string) bool {
+	for _, key := range keys {
+		switch kind {
+		case "direct":
+			if bindingKey == key {
+				return true
+			}
+		case "topic":
+			if topicMatches(strings.Split(bindingKey, "."), strings.Split(key, ".")) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// topicMatches matches routing key words against a topic binding pattern,
+// where "*" is exactly one word and "#" zero or more.
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for n := 0; n <= len(words); n++ {
+			if topicMatches(pattern[1:], words[n:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && words[0] == pattern[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+)
+
+// windowStats summarises the samples the management API returned for
+// a single statistic over the requested window.
+type windowStats struct {
+	Min float64
+	Max float64
+	Avg float64
+}
+
+// sampleParameters returns the query parameters that ask the management
+// API for sample history, or an empty set when sample mode is disabled.
+func sampleParameters(cfg Config) url.Values {
+	values := url.Values{}
+	if cfg.LengthsAge > 0 {
+		values.Set("lengths_age", strconv.Itoa(cfg.LengthsAge))
+		values.Set("lengths_incr", strconv.Itoa(cfg.LengthsIncr))
+	}
+	if cfg.MsgRatesAge > 0 {
+		values.Set("msg_rates_age", strconv.Itoa(cfg.MsgRatesAge))
+		values.Set("msg_rates_incr", strconv.Itoa(cfg.MsgRatesIncr))
+	}
+	return values
+}
+
+func sortedSamples(d rabbithole.RateDetails) []rabbithole.RateDetailSample {
+	samples := make([]rabbithole.RateDetailSample, len(d.Samples))
+	copy(samples, d.Samples)
+	sort.Slice(samples, func(a, b int) bool {
+		return samples[a].Timestamp < samples[b].Timestamp
+	})
+	return samples
+}
+
+// lengthStats treats each sample as an absolute value, which is what the
+// API returns for queue lengths.
+func lengthStats(d rabbithole.RateDetails) (windowStats, bool) {
+	if len(d.Samples) == 0 {
+		return windowStats{}, false
+	}
+	s := windowStats{Min: float64(d.Samples[0].Sample), Max: float64(d.Samples[0].Sample)}
+	var sum float64
+	for _, sample := range d.Samples {
+		v := float64(sample.Sample)
+		if v < s.Min {
+			s.Min = v
+		}
+		if v > s.Max {
+			s.Max = v
+		}
+		sum += v
+	}
+	s.Avg = sum / float64(len(d.Samples))
+	return s, true
+}
+
+// rateStats treats the samples as a cumulative counter and derives the
+// per-second rate between each consecutive pair of samples.
+func rateStats(d rabbithole.RateDetails) (windowStats, bool) {
+	samples := sortedSamples(d)
+	var s windowStats
+	var seen bool
+	for n := 1; n < len(samples); n++ {
+		elapsed := float64(samples[n].Timestamp-samples[n-1].Timestamp) / 1000
+		if elapsed <= 0 {
+			continue
+		}
+		rate := float64(samples[n].Sample-samples[n-1].Sample) / elapsed
+		if !seen || rate < s.Min {
+			s.Min = rate
+		}
+		if !seen || rate > s.Max {
+			s.Max = rate
+		}
+		seen = true
+	}
+	if !seen {
+		return windowStats{}, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	s.Avg = float64(last.Sample-first.Sample) / (float64(last.Timestamp-first.Timestamp) / 1000)
+	return s, true
+}
+
+// setWindowMetrics publishes the min/max/avg of a window using the given
+// metric names.
+func setWindowMetrics(ms *metric.Set, minName, maxName, avgName string, s windowStats, ok bool) {
+	if !ok {
+		return
+	}
+	ms.SetMetric(minName, s.Min, metric.GAUGE)
+	ms.SetMetric(maxName, s.Max, metric.GAUGE)
+	ms.SetMetric(avgName, s.Avg, metric.GAUGE)
+}
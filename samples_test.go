@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+func TestLengthStats(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []rabbithole.RateDetailSample
+		want    windowStats
+		ok      bool
+	}{
+		{name: "empty"},
+		{
+			name:    "single",
+			samples: []rabbithole.RateDetailSample{{Sample: 7, Timestamp: 1000}},
+			want:    windowStats{Min: 7, Max: 7, Avg: 7},
+			ok:      true,
+		},
+		{
+			name:    "newest first",
+			samples: []rabbithole.RateDetailSample{{Sample: 2, Timestamp: 3000}, {Sample: 10, Timestamp: 2000}, {Sample: 6, Timestamp: 1000}},
+			want:    windowStats{Min: 2, Max: 10, Avg: 6},
+			ok:      true,
+		},
+	}
+	for _, c := range cases {
+		got, ok := lengthStats(rabbithole.RateDetails{Samples: c.samples})
+		if ok != c.ok || got != c.want {
+			t.Errorf("%s: got %+v %v, want %+v %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestRateStats(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []rabbithole.RateDetailSample
+		want    windowStats
+		ok      bool
+	}{
+		{name: "empty"},
+		{
+			name:    "single sample has no rate",
+			samples: []rabbithole.RateDetailSample{{Sample: 7, Timestamp: 1000}},
+		},
+		{
+			name:    "duplicate timestamps are skipped",
+			samples: []rabbithole.RateDetailSample{{Sample: 7, Timestamp: 1000}, {Sample: 9, Timestamp: 1000}},
+		},
+		{
+			name: "newest first",
+			samples: []rabbithole.RateDetailSample{
+				{Sample: 100, Timestamp: 16000},
+				{Sample: 40, Timestamp: 11000},
+				{Sample: 30, Timestamp: 6000},
+				{Sample: 0, Timestamp: 1000},
+			},
+			want: windowStats{Min: 2, Max: 12, Avg: 100.0 / 15},
+			ok:   true,
+		},
+	}
+	for _, c := range cases {
+		got, ok := rateStats(rabbithole.RateDetails{Samples: c.samples})
+		if ok != c.ok || got != c.want {
+			t.Errorf("%s: got %+v %v, want %+v %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
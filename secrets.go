@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// secretProvider supplies the management API credentials. It is asked
+// once per run, so rotated secrets are picked up by the next run.
+type secretProvider interface {
+	Credentials(ctx context.Context) (username string, password string, err error)
+}
+
+// newSecretProvider picks the provider from the configuration: Vault when
+// RMQ_VAULT_ADDR is set, files when either credential file is set, and
+// RMQ_USERNAME/RMQ_PASSWORD otherwise.
+func newSecretProvider(cfg Config) secretProvider {
+	static := staticSecrets{Username: cfg.User, Password: cfg.Password}
+	if cfg.VaultAddr != "" {
+		return &vaultSecrets{
+			Addr:        cfg.VaultAddr,
+			Token:       cfg.VaultToken,
+			TokenFile:   cfg.VaultTokenFile,
+			Path:        cfg.VaultPath,
+			UsernameKey: cfg.VaultUsernameKey,
+			PasswordKey: cfg.VaultPasswordKey,
+			client:      &http.Client{},
+		}
+	}
+	if cfg.UserFile != "" || cfg.PasswordFile != "" {
+		return fileSecrets{UsernameFile: cfg.UserFile, PasswordFile: cfg.PasswordFile, Fallback: static}
+	}
+	return static
+}
+
+// loadCredentials replaces cfg.User and cfg.Password with the ones from
+// the configured provider.
+func loadCredentials(ctx context.Context, cfg *Config) error {
+	ctx, cancel := budgetContext(ctx, cfg.NodeTimeout)
+	defer cancel()
+	user, password, err := newSecretProvider(*cfg).Credentials(ctx)
+	if err != nil {
+		return err
+	}
+	cfg.User, cfg.Password = user, password
+	return nil
+}
+
+// staticSecrets are credentials given directly in the configuration.
+type staticSecrets struct {
+	Username string
+	Password string
+}
+
+func (s staticSecrets) Credentials(ctx context.Context) (string, string, error) {
+	return s.Username, s.Password, nil
+}
+
+// fileSecrets reads each credential from its own file, as mounted by a
+// Kubernetes or BOSH secret. A credential without a file comes from Fallback.
+type fileSecrets struct {
+	UsernameFile string
+	PasswordFile string
+	Fallback     staticSecrets
+}
+
+func (s fileSecrets) Credentials(ctx context.Context) (string, string, error) {
+	user, password := s.Fallback.Username, s.Fallback.Password
+	var err error
+	if s.UsernameFile != "" {
+		if user, err = readSecretFile(s.UsernameFile); err != nil {
+			return "", "", err
+		}
+	}
+	if s.PasswordFile != "" {
+		if password, err = readSecretFile(s.PasswordFile); err != nil {
+			return "", "", err
+		}
+	}
+	return user, password, nil
+}
+
+// readSecretFile returns the contents of a secret file without the trailing
+// newline most tools write.
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading secret: %v", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// vaultSecrets reads the credentials from a HashiCorp Vault KV secret.
+// Both KV version 1 paths (secret/rabbitmq) and version 2 paths
+// (secret/data/rabbitmq) are understood.
+type vaultSecrets struct {
+	Addr string
+	// Token authenticates to Vault. TokenFile, when set, is read instead,
+	// e.g. a token written by the Vault agent.
+	Token       string
+	TokenFile   string
+	Path        string
+	UsernameKey string
+	PasswordKey string
+
+	client *http.Client
+}
+
+func (s *vaultSecrets) Credentials(ctx context.Context) (string, string, error) {
+	token := s.Token
+	if s.TokenFile != "" {
+		var err error
+		if token, err = readSecretFile(s.TokenFile); err != nil {
+			return "", "", err
+		}
+	}
+
+	u := strings.TrimRight(s.Addr, "/") + "/v1/" + strings.TrimLeft(s.Path, "/")
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	var secret struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil && res.StatusCode == http.StatusOK {
+		return "", "", fmt.Errorf("reading Vault secret %s: %v", s.Path, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Error %d from Vault reading %s: %s", res.StatusCode, s.Path, strings.Join(secret.Errors, "; "))
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret under data.data, next to data.metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	user, ok := data[s.UsernameKey].(string)
+	if !ok {
+		return "", "", fmt.Errorf("Vault secret %s has no string %q", s.Path, s.UsernameKey)
+	}
+	password, ok := data[s.PasswordKey].(string)
+	if !ok {
+		return "", "", fmt.Errorf("Vault secret %s has no string %q", s.Path, s.PasswordKey)
+	}
+	return user, password, nil
+}
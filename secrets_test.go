@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSecretsReReadEveryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rabbitmq-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+
+	cfg := Config{User: "monitor", PasswordFile: passwordFile}
+	for _, password := range []string{"first", "rotated"} {
+		if err := ioutil.WriteFile(passwordFile, []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		run := cfg
+		if err := loadCredentials(context.Background(), &run); err != nil {
+			t.Fatal(err)
+		}
+		if run.User != "monitor" || run.Password != password {
+			t.Errorf("expected monitor/%s, got %s/%s", password, run.User, run.Password)
+		}
+	}
+
+	cfg.PasswordFile = filepath.Join(dir, "missing")
+	if err := loadCredentials(context.Background(), &cfg); err == nil {
+		t.Error("expected a missing secret file to fail")
+	}
+}
+
+// newFakeVault serves secrets by path to requests carrying token.
+func newFakeVault(token string, secrets map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			writeJSON(w, http.StatusForbidden, map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		secret, ok := secrets[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string][]string{"errors": {}})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"lease_duration": 0, "data": secret})
+	}))
+}
+
+func TestVaultSecrets(t *testing.T) {
+	vault := newFakeVault("s.token", map[string]interface{}{
+		"secret/rabbitmq": map[string]interface{}{"username": "v1-user", "password": "v1-pass"},
+		"secret/data/rabbitmq": map[string]interface{}{
+			"data":     map[string]interface{}{"user": "v2-user", "pass": "v2-pass"},
+			"metadata": map[string]interface{}{"version": 3},
+		},
+	})
+	defer vault.Close()
+
+	cases := []struct {
+		name               string
+		cfg                Config
+		username, password string
+		err                string
+	}{
+		{
+			name:     "kv version 1",
+			cfg:      Config{VaultPath: "secret/rabbitmq", VaultUsernameKey: "username", VaultPasswordKey: "password"},
+			username: "v1-user",
+			password: "v1-pass",
+		},
+		{
+			name:     "kv version 2",
+			cfg:      Config{VaultPath: "/secret/data/rabbitmq", VaultUsernameKey: "user", VaultPasswordKey: "pass"},
+			username: "v2-user",
+			password: "v2-pass",
+		},
+		{
+			name: "missing key",
+			cfg:  Config{VaultPath: "secret/rabbitmq", VaultUsernameKey: "user", VaultPasswordKey: "password"},
+			err:  `has no string "user"`,
+		},
+		{
+			name: "bad token",
+			cfg:  Config{VaultToken: "wrong", VaultPath: "secret/rabbitmq"},
+			err:  "Error 403 from Vault reading secret/rabbitmq: permission denied",
+		},
+		{
+			name: "missing secret",
+			cfg:  Config{VaultPath: "secret/other"},
+			err:  "Error 404",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.cfg.VaultAddr = vault.URL + "/"
+			if c.cfg.VaultToken == "" {
+				c.cfg.VaultToken = "s.token"
+			}
+			err := loadCredentials(context.Background(), &c.cfg)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected an error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.cfg.User != c.username || c.cfg.Password != c.password {
+				t.Errorf("expected %s/%s, got %s/%s", c.username, c.password, c.cfg.User, c.cfg.Password)
+			}
+		})
+	}
+}
+
+func TestVaultTokenFile(t *testing.T) {
+	vault := newFakeVault("s.from-file", map[string]interface{}{
+		"secret/rabbitmq": map[string]interface{}{"username": "u", "password": "p"},
+	})
+	defer vault.Close()
+
+	f, err := ioutil.TempFile("", "vault-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("s.from-file\n")
+	f.Close()
+
+	cfg := Config{VaultAddr: vault.URL, VaultTokenFile: f.Name(), VaultPath: "secret/rabbitmq", VaultUsernameKey: "username", VaultPasswordKey: "password"}
+	if err := loadCredentials(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.User != "u" || cfg.Password != "p" {
+		t.Errorf("expected u/p, got %s/%s", cfg.User, cfg.Password)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// Bindings from the default exchange are implicit: every queue has one,
+// keyed by its own name. They are left out of the inventory and the graph
+// so they don't bury the bindings someone declared.
+func declaredBindings(bs []rabbithole.BindingInfo) []rabbithole.BindingInfo {
+	var declared []rabbithole.BindingInfo
+	for _, b := range bs {
+		if b.Source != "" {
+			declared = append(declared, b)
+		}
+	}
+	return declared
+}
+
+// bindingArguments returns the binding arguments as a JSON object.
+func bindingArguments(b rabbithole.BindingInfo) string {
+	if len(b.Arguments) == 0 {
+		return "{}"
+	}
+	args, err := json.Marshal(b.Arguments)
+	if err != nil {
+		return "{}"
+	}
+	return string(args)
+}
+
+// populateBindingInventory stores every declared binding in bs as an
+// inventory item on its source exchange and on its destination queue or
+// exchange.
+func populateBindingInventory(i *integration.Integration, bs []rabbithole.BindingInfo, cfg Config) error {
+	for _, b := range declaredBindings(bs) {
+		source, err := i.Entity(exchangeEntityName(cfg, b.Vhost, b.Source), "exchange")
+		if err != nil {
+			return err
+		}
+		destination, err := bindingDestination(i, cfg, b)
+		if err != nil {
+			return err
+		}
+		// the properties key is already URL-encoded by the broker
+		key := entityKey("binding", b.Source, b.DestinationType, b.Destination) + "/" + b.PropertiesKey
+		for _, e := range []*integration.Entity{source, destination} {
+			e.Inventory.SetItem(key, "vhost", b.Vhost)
+			e.Inventory.SetItem(key, "source", b.Source)
+			e.Inventory.SetItem(key, "destination", b.Destination)
+			e.Inventory.SetItem(key, "destination_type", b.DestinationType)
+			e.Inventory.SetItem(key, "routing_key", b.RoutingKey)
+			e.Inventory.SetItem(key, "arguments", bindingArguments(b))
+		}
+	}
+	return nil
+}
+
+func bindingDestination(i *integration.Integration, cfg Config, b rabbithole.BindingInfo) (*integration.Entity, error) {
+	if b.DestinationType == "exchange" {
+		return i.Entity(exchangeEntityName(cfg, b.Vhost, b.Destination), "exchange")
+	}
+	return i.Entity(queueEntityName(cfg, b.Vhost, b.Destination), "queue")
+}
+
+// topologyGraph is the routing graph written by --topology. Node IDs are
+// the names of the matching entities.
+type topologyGraph struct {
+	Cluster string         `json:"cluster"`
+	Nodes   []topologyNode `json:"nodes"`
+	Edges   []topologyEdge `json:"edges"`
+}
+
+type topologyNode struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Vhost string `json:"vhost"`
+	Name  string `json:"name"`
+}
+
+type topologyEdge struct {
+	Source          string                 `json:"source"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// buildTopology turns the declared bindings into a graph of exchanges and
+// the queues and exchanges they route to.
+func buildTopology(cfg Config, bs []rabbithole.BindingInfo) topologyGraph {
+	graph := topologyGraph{Cluster: cfg.Cluster, Nodes: []topologyNode{}, Edges: []topologyEdge{}}
+	nodes := map[string]topologyNode{}
+	for _, b := range declaredBindings(bs) {
+		source := topologyNode{ID: exchangeEntityName(cfg, b.Vhost, b.Source), Type: "exchange", Vhost: b.Vhost, Name: b.Source}
+		destination := topologyNode{ID: exchangeEntityName(cfg, b.Vhost, b.Destination), Type: "exchange", Vhost: b.Vhost, Name: b.Destination}
+		if b.DestinationType != "exchange" {
+			destination.ID = queueEntityName(cfg, b.Vhost, b.Destination)
+			destination.Type = "queue"
+		}
+		nodes[source.ID] = source
+		nodes[destination.ID] = destination
+
+		arguments := b.Arguments
+		if arguments == nil {
+			arguments = map[string]interface{}{}
+		}
+		graph.Edges = append(graph.Edges, topologyEdge{
+			Source:          source.ID,
+			Destination:     destination.ID,
+			DestinationType: destination.Type,
+			RoutingKey:      b.RoutingKey,
+			Arguments:       arguments,
+		})
+	}
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	sort.Slice(graph.Nodes, func(a, b int) bool { return graph.Nodes[a].ID < graph.Nodes[b].ID })
+	sort.SliceStable(graph.Edges, func(a, b int) bool {
+		x, y := graph.Edges[a], graph.Edges[b]
+		if x.Source != y.Source {
+			return x.Source < y.Source
+		}
+		if x.Destination != y.Destination {
+			return x.Destination < y.Destination
+		}
+		return x.RoutingKey < y.RoutingKey
+	})
+	return graph
+}
+
+// dotQuote quotes s as a Graphviz ID.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// writeDOT writes the graph with one subgraph per vhost. Exchanges are
+// boxes, queues ellipses and edges are labelled with the routing key.
+func writeDOT(w io.Writer, graph topologyGraph) error {
+	var vhosts []string
+	byVhost := map[string][]topologyNode{}
+	for _, node := range graph.Nodes {
+		if _, ok := byVhost[node.Vhost]; !ok {
+			vhosts = append(vhosts, node.Vhost)
+		}
+		byVhost[node.Vhost] = append(byVhost[node.Vhost], node)
+	}
+	sort.Strings(vhosts)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n\trankdir=LR;\n", dotQuote(graph.Cluster))
+	for n, vhost := range vhosts {
+		fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", n, dotQuote(vhost))
+		for _, node := range byVhost[vhost] {
+			shape := "box"
+			if node.Type == "queue" {
+				shape = "ellipse"
+			}
+			fmt.Fprintf(&b, "\t\t%s [label=%s, shape=%s];\n", dotQuote(node.ID), dotQuote(node.Name), shape)
+		}
+		b.WriteString("\t}\n")
+	}
+	for _, edge := range graph.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s [label=%s];\n", dotQuote(edge.Source), dotQuote(edge.Destination), dotQuote(edge.RoutingKey))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeTopology writes the cluster's routing graph to w as "json" or "dot".
+func writeTopology(ctx context.Context, w io.Writer, rmqc managementClient, cfg Config, format string) error {
+	if format != "json" && format != "dot" {
+		return fmt.Errorf("unknown --topology format %q, expected json or dot", format)
+	}
+	cfg.Cluster = clusterIdentity(ctx, rmqc, cfg)
+	budgeted, cancel := withBudget(ctx, rmqc, cfg.NodeTimeout)
+	defer cancel()
+	bs, err := budgeted.ListBindings()
+	if err != nil {
+		return err
+	}
+	graph := buildTopology(cfg, bs)
+	if format == "dot" {
+		return writeDOT(w, graph)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(graph)
+}
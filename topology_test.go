@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+)
+
+// testBindings routes the orders exchange to a queue and, through the
+// audit exchange, to a queue whose name holds a slash.
+var testBindings = []rabbithole.BindingInfo{
+	{Source: "", Vhost: "/", Destination: "orders.eu", DestinationType: "queue", RoutingKey: "orders.eu", PropertiesKey: "orders.eu"},
+	{Source: "orders", Vhost: "/", Destination: "orders.eu", DestinationType: "queue", RoutingKey: "eu.#", PropertiesKey: "eu.%23"},
+	{Source: "orders", Vhost: "/", Destination: "audit", DestinationType: "exchange", RoutingKey: "#", PropertiesKey: "%23"},
+	{Source: "audit", Vhost: "/", Destination: "audit/log", DestinationType: "queue", Arguments: map[string]interface{}{"x-match": "all", "region": "eu"}, PropertiesKey: "~abc"},
+}
+
+func TestWriteTopologyJSON(t *testing.T) {
+	srv := newFakeManagement(&fakeManagement{Nodes: 1, Bindings: testBindings})
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := writeTopology(context.Background(), &buf, newTestClient(t, srv.URL), Config{Cluster: "prod"}, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var graph topologyGraph
+	if err := json.Unmarshal(buf.Bytes(), &graph); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	if len(graph.Nodes) != 4 || len(graph.Edges) != 3 {
+		t.Fatalf("expected 4 nodes and 3 edges without the default exchange, got %+v", graph)
+	}
+	if e := graph.Edges[0]; e.Source != "prod/%2F/audit" || e.Destination != "prod/%2F/audit%2Flog" || e.Arguments["region"] != "eu" {
+		t.Errorf("unexpected first edge %+v", e)
+	}
+	if e := graph.Edges[1]; e.Destination != "prod/%2F/audit" || e.DestinationType != "exchange" || e.RoutingKey != "#" {
+		t.Errorf("unexpected exchange to exchange edge %+v", e)
+	}
+}
+
+func TestWriteTopologyDOT(t *testing.T) {
+	srv := newFakeManagement(&fakeManagement{Nodes: 1, Bindings: testBindings})
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := writeTopology(context.Background(), &buf, newTestClient(t, srv.URL), Config{Cluster: "prod"}, "dot"); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph "prod" {
+	rankdir=LR;
+	subgraph cluster_0 {
+		label="/";
+		"prod/%2F/audit" [label="audit", shape=box];
+		"prod/%2F/audit%2Flog" [label="audit/log", shape=ellipse];
+		"prod/%2F/orders" [label="orders", shape=box];
+		"prod/%2F/orders.eu" [label="orders.eu", shape=ellipse];
+	}
+	"prod/%2F/audit" -> "prod/%2F/audit%2Flog" [label=""];
+	"prod/%2F/orders" -> "prod/%2F/audit" [label="#"];
+	"prod/%2F/orders" -> "prod/%2F/orders.eu" [label="eu.#"];
+}
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s", buf.String())
+	}
+
+	if err := writeTopology(context.Background(), &buf, newTestClient(t, srv.URL), Config{Cluster: "prod"}, "svg"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+func TestBindingInventoryListsBindingsOnce(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1, Queues: 2, Bindings: testBindings}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+
+	payload, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 1}, argumentList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `"binding/orders/queue/orders.eu/eu.%23"`) {
+		t.Errorf("expected the binding inventory, got %s", payload)
+	}
+	lists := 0
+	for _, uri := range fake.Requests() {
+		if uri == "/api/bindings/" {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("expected the bindings to be listed once, got %d", lists)
+	}
+}
+
+func TestBindingInventoryUnauthorized(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1, Queues: 2, Bindings: testBindings, Status: map[string]int{"/api/bindings/": 403}}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+
+	payload, err := runCollect(t, newTestClient(t, srv.URL), Config{Cluster: "c", Workers: 1}, argumentList{})
+	if err != nil {
+		t.Fatalf("a user that can't list bindings should still be collected: %v", err)
+	}
+	if n := countEntities(t, payload, "queue"); n != 2 {
+		t.Errorf("expected both queues to be reported, got %d", n)
+	}
+}
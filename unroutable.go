@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jordanbcooper/newrelic-integration-rabbitmq/policy"
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/data/event"
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// populateUnroutable reports the messages no queue took: mandatory ones
+// returned to their publisher and the rest, which are silently dropped. An
+// event is sent on the run where drops start.
+func populateUnroutable(e *integration.Entity, ms *metric.Set, res *rabbithole.Overview, cfg Config) error {
+	stats := res.MessageStats
+	ms.SetMetric("Return Unroutable", stats.ReturnUnroutable, metric.GAUGE)
+	ms.SetMetric("Return Unroutable Rate", stats.ReturnUnroutableDetails.Rate, metric.GAUGE)
+	ms.SetMetric("Drop Unroutable", stats.DropUnroutable, metric.GAUGE)
+	ms.SetMetric("Drop Unroutable Rate", stats.DropUnroutableDetails.Rate, metric.GAUGE)
+
+	key := "drop_unroutable:" + overviewEntityName(cfg)
+	var wasDropping bool
+	cfg.State.Get(key, &wasDropping)
+	dropping := stats.DropUnroutableDetails.Rate > 0
+	cfg.State.Set(key, dropping)
+	if !dropping || wasDropping {
+		return nil
+	}
+	summary := fmt.Sprintf("Unroutable messages are being dropped: %.1f/s (%d in total). Check for dead-end exchanges and mistyped routing keys", stats.DropUnroutableDetails.Rate, stats.DropUnroutable)
+	return e.AddEvent(event.New(summary, "RabbitMQ"))
+}
+
+// isDeadEnd reports whether messages published to x have nowhere to go:
+// it receives publishes but has no bindings and no alternate exchange,
+// whether set as an argument or by its policy. The default exchange
+// routes by queue name and is never a dead end.
+func isDeadEnd(x rabbithole.ExchangeInfo, r *routing) bool {
+	if x.Name == "" || x.MessageStats.PublishInDetails.Rate <= 0 {
+		return false
+	}
+	if _, ok := x.Arguments["alternate-exchange"]; ok {
+		return false
+	}
+	name := x.Policy
+	if name == "" && r.Resolver != nil {
+		name = r.Resolver.Resolve(policy.Object{Vhost: x.Vhost, Name: x.Name, Kind: "exchange"}).Policy
+	}
+	if _, ok := r.policyDefinition(x.Vhost, name)["alternate-exchange"]; ok {
+		return false
+	}
+	return len(r.from[[2]string{x.Vhost, x.Name}]) == 0
+}
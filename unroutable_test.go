@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jordanbcooper/rabbit-hole"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestIsDeadEnd(t *testing.T) {
+	published := func(x rabbithole.ExchangeInfo) rabbithole.ExchangeInfo {
+		x.MessageStats.PublishInDetails.Rate = 3
+		return x
+	}
+	routes := newRouting(testBindings, nil, []rabbithole.Policy{
+		{Vhost: "/", Name: "ae", Pattern: "^unbound", ApplyTo: "exchanges", Definition: rabbithole.PolicyDefinition{"alternate-exchange": "unrouted"}},
+	})
+	cases := []struct {
+		name     string
+		exchange rabbithole.ExchangeInfo
+		deadEnd  bool
+	}{
+		{"no bindings", published(rabbithole.ExchangeInfo{Name: "typo", Vhost: "/"}), true},
+		{"bound", published(rabbithole.ExchangeInfo{Name: "orders", Vhost: "/"}), false},
+		{"bound in another vhost", published(rabbithole.ExchangeInfo{Name: "orders", Vhost: "test"}), true},
+		{"alternate exchange", published(rabbithole.ExchangeInfo{Name: "typo", Vhost: "/", Arguments: map[string]interface{}{"alternate-exchange": "unrouted"}}), false},
+		{"alternate exchange from the policy", published(rabbithole.ExchangeInfo{Name: "unbound", Vhost: "/", Policy: "ae"}), false},
+		{"alternate exchange from a policy the broker didn't report", published(rabbithole.ExchangeInfo{Name: "unbound", Vhost: "/"}), false},
+		{"policy without an alternate exchange", published(rabbithole.ExchangeInfo{Name: "typo", Vhost: "/", Policy: "other"}), true},
+		{"no publishes", rabbithole.ExchangeInfo{Name: "typo", Vhost: "/"}, false},
+		{"default exchange", published(rabbithole.ExchangeInfo{Name: "", Vhost: "/"}), false},
+	}
+	for _, c := range cases {
+		if got := isDeadEnd(c.exchange, routes); got != c.deadEnd {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+}
+
+// entityEvents returns the summaries of the events on entities of type
+// entityType.
+func entityEvents(t *testing.T, payload []byte, entityType string) []string {
+	var doc struct {
+		Data []struct {
+			Entity struct{ Type string }
+			Events []struct{ Summary string }
+		}
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var summaries []string
+	for _, e := range doc.Data {
+		if e.Entity.Type == entityType {
+			for _, ev := range e.Events {
+				summaries = append(summaries, ev.Summary)
+			}
+		}
+	}
+	return summaries
+}
+
+// overviewEvents returns the summaries of the events on the overview entity.
+func overviewEvents(t *testing.T, payload []byte) []string {
+	return entityEvents(t, payload, "cluster_overview")
+}
+
+func TestUnroutableDropEvent(t *testing.T) {
+	fake := &fakeManagement{Nodes: 1}
+	srv := newFakeManagement(fake)
+	defer srv.Close()
+	cfg := Config{Cluster: "c", Workers: 1, State: persist.NewInMemoryStore()}
+
+	// drops start, continue, stop and start again
+	for n, c := range []struct {
+		rate  float32
+		event bool
+	}{{0, false}, {2, true}, {4, false}, {0, false}, {1, true}} {
+		fake.DropUnroutable = c.rate
+		payload, err := runCollect(t, newTestClient(t, srv.URL), cfg, argumentList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := overviewEvents(t, payload)
+		if c.event != (len(events) == 1 && strings.HasPrefix(events[0], "Unroutable messages are being dropped")) {
+			t.Errorf("run %d: unexpected events %q", n, events)
+		}
+	}
+}